@@ -1,10 +1,14 @@
 package app
 
 import (
+	"context"
 	"fmt"
+	"strings"
 )
 
-// App represents a self-contained instance of this app
+// App represents a self-contained instance of this app.
+// Its methods return errors instead of exiting the process, so that it can be embedded into other programs.
+// ExitCode tells the exit code a command-line interface should exit with for the errors
 type App struct {
 	*Context
 	vaults []*VaultBuilder
@@ -43,59 +47,383 @@ func (a *App) vaultConfigs() []*VaultConfig {
 	return cfgs
 }
 
-// Run executes the command provided via the command-line args, with temporarily decrypting necessary files according to the appropriate config
-func (a *App) Run(cmd string, args ...string) {
-	var cfg *VaultConfig
+// vaultConfig returns the config of the named vault
+func (a *App) vaultConfig(vault string) (*VaultConfig, error) {
+	for _, c := range a.vaultConfigs() {
+		if c.vaultName == vault {
+			return c, nil
+		}
+	}
+	return nil, withExitCode(ExitNoVault, fmt.Errorf("no vault found: %s", vault))
+}
+
+// newJob prepares a job to decrypt or encrypt the vault for the environment selected by Context.Env
+func (a *App) newJob(cfg *VaultConfig) (*Job, error) {
+	if err := checkEnv(a.Env); err != nil {
+		return nil, withExitCode(ExitConfigError, err)
+	}
+	root, err := cfg.vaultRoot(a.Env)
+	if err != nil {
+		return nil, withExitCode(ExitConfigError, err)
+	}
+	return &Job{VaultConfig: cfg, context: a.Context, root: root}, nil
+}
+
+// handlesCommand returns true if any of the vaults is configured for the command
+func (a *App) handlesCommand(cmd string) bool {
+	for _, c := range a.vaultConfigs() {
+		if c.handlesCommand(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run executes the command provided via the command-line args, with temporarily decrypting necessary files according to the appropriate config.
+// The exit code is the one of the command, or one of sopsed's own exit codes when sopsed failed.
+// Cancelling ctx stops waiting for locks on vaults, or sends SIGTERM to the command, and the files are cleaned up before returning
+func (a *App) Run(ctx context.Context, cmd string, args ...string) (int, error) {
+	err := a.run(ctx, cmd, args...)
+	return ExitCode(err), err
+}
+
+func (a *App) run(ctx context.Context, cmd string, args ...string) error {
+	// Files left behind unchanged are safe to be removed, as they are still in the vault
+	remaining, err := recoverLeftovers(a.Context)
+	if err != nil {
+		return fmt.Errorf("failed to clean up files left behind by interrupted runs: %v", err)
+	}
+	if len(remaining) > 0 {
+		warnLeftovers(a.Context)
+	}
+
+	// All the vaults matching the invocation are decrypted together, e.g. kubeconfig and chart values for helmfile
+	jobs := []*Job{}
 	for _, c := range a.vaultConfigs() {
 		if c.MatchesCommand(cmd, args...) {
-			cfg = c
-			break
+			a.info.Printf("using vault: %s\n", c.vaultName)
+			job, err := a.newJob(c)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) == 0 {
+		if !a.handlesCommand(cmd) {
+			return withExitCode(ExitNoVault, fmt.Errorf("no config found for command: %s", cmd))
 		}
+		// The command is known but none of its vaults are needed for these args, e.g. `kube-aws version`
+		a.info.Printf("using no vault for: %s %s\n", cmd, strings.Join(args, " "))
+		return runInForeground(ctx, nil, cmd, args...)
+	}
+	return runWithVaults(ctx, a.Context, jobs, cmd, args...)
+}
+
+// Exec runs any command with temporarily decrypting the named vaults, regardless of the commands the vaults are configured for.
+// The exit code and the cancellation of ctx are handled the same as Run
+func (a *App) Exec(ctx context.Context, vaults []string, cmd string, args ...string) (int, error) {
+	err := a.exec(ctx, vaults, cmd, args...)
+	return ExitCode(err), err
+}
+
+func (a *App) exec(ctx context.Context, vaults []string, cmd string, args ...string) error {
+	if len(vaults) == 0 {
+		return withExitCode(ExitNoVault, fmt.Errorf("no vault specified. specify one or more vaults with --vault"))
+	}
+
+	remaining, err := recoverLeftovers(a.Context)
+	if err != nil {
+		return fmt.Errorf("failed to clean up files left behind by interrupted runs: %v", err)
 	}
-	if cfg == nil {
-		a.Context.ExitWithError(fmt.Errorf("no config found for command: %s", cmd))
+	if len(remaining) > 0 {
+		warnLeftovers(a.Context)
+	}
+
+	jobs := []*Job{}
+	seen := map[string]bool{}
+	for _, vault := range vaults {
+		if seen[vault] {
+			continue
+		}
+		seen[vault] = true
+		cfg, err := a.vaultConfig(vault)
+		if err != nil {
+			return err
+		}
+		a.info.Printf("using vault: %s\n", cfg.vaultName)
+		job, err := a.newJob(cfg)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	return runWithVaults(ctx, a.Context, jobs, cmd, args...)
+}
+
+// Decrypt a named vault. Cancelling ctx stops waiting for the lock on the vault
+func (a *App) Decrypt(ctx context.Context, vault string) (int, error) {
+	err := a.decrypt(ctx, vault)
+	return ExitCode(err), err
+}
+
+func (a *App) decrypt(ctx context.Context, vault string) error {
+	warnLeftovers(a.Context)
+
+	cfg, err := a.vaultConfig(vault)
+	if err != nil {
+		return err
+	}
+	a.info.Printf("using vault: %s\n", cfg.vaultName)
+	job, err := a.newJob(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = job.Decrypt(ctx)
+	return err
+}
+
+// Encrypt files into a named vault. Cancelling ctx stops waiting for the lock on the vault
+func (a *App) Encrypt(ctx context.Context, vault string) (int, error) {
+	err := a.encrypt(ctx, vault)
+	return ExitCode(err), err
+}
+
+func (a *App) encrypt(ctx context.Context, vault string) error {
+	warnLeftovers(a.Context)
+
+	cfg, err := a.vaultConfig(vault)
+	if err != nil {
+		return err
+	}
+	a.info.Printf("using vault: %s\n", cfg.vaultName)
+	job, err := a.newJob(cfg)
+	if err != nil {
+		return err
+	}
+	return job.Encrypt(ctx)
+}
+
+// Migrate converts a named vault into the layout, either SingleLayout or PerFileLayout
+func (a *App) Migrate(ctx context.Context, vault string, layout string) error {
+	warnLeftovers(a.Context)
+
+	cfg, err := a.vaultConfig(vault)
+	if err != nil {
+		return err
+	}
+	if err := checkLayout(cfg.vaultName, layout); err != nil {
+		return withExitCode(ExitConfigError, err)
 	}
 	a.info.Printf("using vault: %s\n", cfg.vaultName)
-	job := &Job{VaultConfig: cfg, context: a.Context}
-	if err := job.RunOrPanic(cmd, args...); err != nil {
-		a.Context.ExitWithError(err)
+	job, err := a.newJob(cfg)
+	if err != nil {
+		return err
+	}
+	return job.Migrate(ctx, layout)
+}
+
+// Rotate re-encrypts the named vaults, or all the vaults encrypted for the environment when all is true, with new data keys
+func (a *App) Rotate(ctx context.Context, vaults []string, all bool) error {
+	warnLeftovers(a.Context)
+
+	if len(vaults) == 0 && !all {
+		return fmt.Errorf("specify vaults to rotate, or --all to rotate all the vaults")
+	}
+	jobs := []*Job{}
+	for _, c := range a.vaultConfigs() {
+		if !all && !containsString(vaults, c.vaultName) {
+			continue
+		}
+		job, err := a.newJob(c)
+		if err != nil {
+			return err
+		}
+		if all && !vaultExists(job.encryptedVault()) {
+			continue
+		}
+		jobs = append(jobs, job)
 	}
+	for _, vault := range vaults {
+		found := false
+		for _, j := range jobs {
+			found = found || j.vaultName == vault
+		}
+		if !found {
+			return withExitCode(ExitNoVault, fmt.Errorf("no vault found: %s", vault))
+		}
+	}
+
+	failures := []string{}
+	var lastErr error
+	for _, job := range jobs {
+		if err := job.Rotate(ctx); err != nil {
+			a.err.Println(describeError(err))
+			failures = append(failures, job.vaultName)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return withExitCode(exitCodeOf(lastErr), fmt.Errorf("failed to rotate %d of %d vault(s): %s", len(failures), len(jobs), strings.Join(failures, ", ")))
+	}
+	return nil
 }
 
-// Decrypt a named vault
-func (a *App) Decrypt(vault string) {
-	var cfg *VaultConfig
+// ListKeys returns the master keys of the named vaults, or all the vaults encrypted for the environment when none is named
+func (a *App) ListKeys(vaults []string) ([]VaultKeys, error) {
+	warnLeftovers(a.Context)
+
+	jobs := []*Job{}
 	for _, c := range a.vaultConfigs() {
-		if c.vaultName == vault {
-			cfg = c
-			break
+		if len(vaults) > 0 && !containsString(vaults, c.vaultName) {
+			continue
+		}
+		job, err := a.newJob(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(vaults) == 0 && !vaultExists(job.encryptedVault()) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	for _, vault := range vaults {
+		found := false
+		for _, j := range jobs {
+			found = found || j.vaultName == vault
+		}
+		if !found {
+			return nil, withExitCode(ExitNoVault, fmt.Errorf("no vault found: %s", vault))
+		}
+	}
+	listings := []VaultKeys{}
+	for _, job := range jobs {
+		keys, err := job.ListKeys()
+		if err != nil {
+			return nil, err
 		}
+		listings = append(listings, *keys)
 	}
-	if cfg == nil {
-		a.Context.ExitWithError(fmt.Errorf("no vault found: %s", vault))
+	return listings, nil
+}
+
+// UpdateKeys adds and removes the master keys in Context.Recipients to and from a named vault
+func (a *App) UpdateKeys(ctx context.Context, vault string) error {
+	warnLeftovers(a.Context)
+
+	cfg, err := a.vaultConfig(vault)
+	if err != nil {
+		return err
+	}
+	job, err := a.newJob(cfg)
+	if err != nil {
+		return err
+	}
+	return job.UpdateKeys(ctx)
+}
+
+// Verify that the files restored from a named vault are identical to the ones in the vault
+func (a *App) Verify(vault string) error {
+	warnLeftovers(a.Context)
+
+	cfg, err := a.vaultConfig(vault)
+	if err != nil {
+		return err
+	}
+	a.info.Printf("using vault: %s\n", cfg.vaultName)
+	job, err := a.newJob(cfg)
+	if err != nil {
+		return err
+	}
+	return job.Verify()
+}
+
+// ImportEnv imports environment variables from a dotenv file into a named vault
+func (a *App) ImportEnv(ctx context.Context, vault string, dotenvFile string) error {
+	warnLeftovers(a.Context)
+
+	cfg, err := a.vaultConfig(vault)
+	if err != nil {
+		return err
 	}
 	a.info.Printf("using vault: %s\n", cfg.vaultName)
-	job := &Job{VaultConfig: cfg, context: a.Context}
-	if _, err := job.Decrypt(); err != nil {
-		a.Context.ExitWithError(err)
+	job, err := a.newJob(cfg)
+	if err != nil {
+		return err
+	}
+	return job.ImportEnv(ctx, dotenvFile)
+}
+
+// Recover removes cleartext files left behind by interrupted sopsed processes and puts back the files backed up by them.
+// Files changed since they were restored are never removed
+func (a *App) Recover() error {
+	remaining, err := recoverLeftovers(a.Context)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", journalFile, err)
+	}
+	if len(remaining) == 0 {
+		a.info.Println("no cleartext file is left behind")
+		return nil
+	}
+	lines := []string{}
+	for _, l := range remaining {
+		lines = append(lines, l.String())
+	}
+	return fmt.Errorf("left the following files as-is:\n%s\nencrypt the changed ones with `sopsed encrypt VAULT` to keep the changes, or remove them by yourself", strings.Join(lines, "\n"))
+}
+
+// VaultEnvs is the environments a vault is encrypted for
+type VaultEnvs struct {
+	Vault string
+	// Envs is the names of the environments, which is empty for the default one
+	Envs []string
+}
+
+// String returns the environments as printed by `sopsed envs`
+func (v VaultEnvs) String() string {
+	names := []string{}
+	for _, env := range v.Envs {
+		if env == "" {
+			env = "(default)"
+		}
+		names = append(names, env)
+	}
+	if len(names) == 0 {
+		names = append(names, "(not encrypted yet)")
 	}
+	return fmt.Sprintf("%s: %s", v.Vault, strings.Join(names, ", "))
 }
 
-// Decrypt a named vault
-func (a *App) Encrypt(vault string) {
-	var cfg *VaultConfig
+// ListEnvs returns the environments the named vaults, or all the vaults when none is named, are encrypted for
+func (a *App) ListEnvs(vaults []string) ([]VaultEnvs, error) {
+	warnLeftovers(a.Context)
+
+	cfgs := []*VaultConfig{}
 	for _, c := range a.vaultConfigs() {
-		if c.vaultName == vault {
-			cfg = c
-			break
+		if len(vaults) == 0 || containsString(vaults, c.vaultName) {
+			cfgs = append(cfgs, c)
 		}
 	}
-	if cfg == nil {
-		a.Context.ExitWithError(fmt.Errorf("no vault found: %s", vault))
+	for _, vault := range vaults {
+		found := false
+		for _, c := range cfgs {
+			found = found || c.vaultName == vault
+		}
+		if !found {
+			return nil, withExitCode(ExitNoVault, fmt.Errorf("no vault found: %s", vault))
+		}
 	}
-	a.info.Printf("using vault: %s\n", cfg.vaultName)
-	job := &Job{VaultConfig: cfg, context: a.Context}
-	if err := job.Encrypt(); err != nil {
-		a.Context.ExitWithError(err)
+	listings := []VaultEnvs{}
+	for _, c := range cfgs {
+		root, err := c.vaultRoot(a.Env)
+		if err != nil {
+			return nil, withExitCode(ExitConfigError, err)
+		}
+		envs, err := c.envs(root)
+		if err != nil {
+			return nil, err
+		}
+		listings = append(listings, VaultEnvs{Vault: c.vaultName, Envs: envs})
 	}
+	return listings, nil
 }
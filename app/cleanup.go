@@ -0,0 +1,274 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// forwardedSignals are relayed to the wrapped command so that it can exit gracefully before we clean up
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// cleanup removes restored cleartext files exactly once, whether it is triggered by a defer or by a failure to restore the files
+type cleanup struct {
+	context *Context
+	// vault is the name of the vault the files are restored from
+	vault string
+	paths []string
+	// checksums maps restored files to their hashes recorded in the journal, including the ones in a private directory
+	checksums map[string]string
+	// backups maps files to the backups of the cleartext files existed before restoring, which are put back instead of removing the files
+	backups map[string]string
+	tracked bool
+	once    sync.Once
+	// before is called before removing files. Files are removed only when it returns true.
+	// When it fails, nothing including the record is touched so that the next invocation finishes the cleanup
+	before func() (bool, error)
+	// after is called after removing files
+	after func()
+}
+
+func newCleanup(context *Context, vault string, paths ...string) *cleanup {
+	return &cleanup{
+		context:   context,
+		vault:     vault,
+		paths:     paths,
+		checksums: map[string]string{},
+		backups:   map[string]string{},
+	}
+}
+
+// track records the files in the journal so that `sopsed recover` removes them even when the process is killed before cleaning up.
+// Call this before restoring any file so that no cleartext is left untracked
+func (c *cleanup) track() error {
+	paths := append([]string{}, c.paths...)
+	for p := range c.checksums {
+		if !containsString(c.paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	if err := c.journal(paths...); err != nil {
+		return err
+	}
+	c.tracked = true
+	return nil
+}
+
+// journal appends the files to the journal
+func (c *cleanup) journal(paths ...string) error {
+	if err := updateJournal(func(entries []journalEntry) []journalEntry {
+		for _, p := range paths {
+			entries = append(entries, newJournalEntry(c.vault, p, c.checksums[p], c.backups[p]))
+		}
+		return entries
+	}); err != nil {
+		return fmt.Errorf("failed to record files to be cleaned up in %s: %v", journalFile, err)
+	}
+	return nil
+}
+
+// add arranges the files to be removed as well
+func (c *cleanup) add(paths ...string) {
+	c.paths = append(c.paths, paths...)
+	c.record(paths...)
+}
+
+// record adds the files created after tracking to the journal
+func (c *cleanup) record(paths ...string) {
+	if !c.tracked {
+		return
+	}
+	for _, p := range paths {
+		if sum, err := fileChecksum(p); err == nil {
+			c.checksums[p] = sum
+		}
+	}
+	if err := c.journal(paths...); err != nil {
+		c.context.warn.Println(err.Error())
+	}
+}
+
+// rehash updates the hashes of the files in the journal, so that the files written back into the vault are recovered after a crash
+func (c *cleanup) rehash(paths ...string) {
+	if !c.tracked {
+		return
+	}
+	for _, p := range paths {
+		if sum, err := fileChecksum(p); err == nil {
+			c.checksums[p] = sum
+		}
+	}
+	err := updateJournal(func(entries []journalEntry) []journalEntry {
+		for i, e := range entries {
+			if sum, ok := c.checksums[e.Path]; ok && e.Pid == os.Getpid() {
+				entries[i].Checksum = sum
+			}
+		}
+		return entries
+	})
+	if err != nil {
+		c.context.warn.Printf("failed to update %s: %v\n", journalFile, err)
+	}
+}
+
+// keep excludes the files from the files to be removed
+func (c *cleanup) keep(paths ...string) {
+	kept := map[string]bool{}
+	for _, p := range paths {
+		kept[p] = true
+		delete(c.checksums, p)
+		if backup, ok := c.backups[p]; ok {
+			c.context.warn.Printf("keeping %s. the file existed before restoring it is backed up at %s\n", p, backup)
+		}
+	}
+	remaining := []string{}
+	for _, p := range c.paths {
+		if !kept[p] {
+			remaining = append(remaining, p)
+		}
+	}
+	c.paths = remaining
+}
+
+func (c *cleanup) run() {
+	c.once.Do(func() {
+		defer func() {
+			if c.after != nil {
+				c.after()
+			}
+		}()
+		remove := true
+		if c.before != nil {
+			var err error
+			remove, err = c.before()
+			if err != nil {
+				c.context.err.Printf("failed to clean up %s: %v\n", strings.Join(c.paths, ", "), err)
+				return
+			}
+		}
+		failed := map[string]bool{}
+		if remove {
+			failed = c.remove()
+		}
+		if !c.tracked {
+			return
+		}
+		err := updateJournal(func(entries []journalEntry) []journalEntry {
+			remaining := []journalEntry{}
+			for _, e := range entries {
+				if e.Pid != os.Getpid() || failedUnder(failed, e.Path) {
+					remaining = append(remaining, e)
+				}
+			}
+			return remaining
+		})
+		if err != nil {
+			c.context.warn.Printf("failed to update %s: %v\n", journalFile, err)
+		}
+		if len(failed) > 0 {
+			c.context.warn.Printf("CLEARTEXT FILES ARE LEFT BEHIND. run `sopsed recover` to clean them up\n")
+		}
+	})
+}
+
+// remove removes the restored files, or puts back the backups of them if any
+func (c *cleanup) remove() map[string]bool {
+	failed := map[string]bool{}
+	for _, p := range c.paths {
+		backup, ok := c.backups[p]
+		if !ok {
+			for f := range removeFiles(c.context, p) {
+				failed[f] = true
+			}
+			continue
+		}
+		if _, err := putBack(c.context, p, backup); err != nil {
+			c.context.warn.Printf("failed to put back %s from %s: %v. BEWARE THAT %s IS THE ONE RESTORED FROM THE VAULT!\n", p, backup, err, p)
+			failed[p] = true
+		}
+	}
+	return failed
+}
+
+// removeFiles removes the files and returns the set of files failed to be removed.
+// A private directory is removed along with its contents
+func removeFiles(context *Context, paths ...string) map[string]bool {
+	failed := map[string]bool{}
+	for _, path := range paths {
+		context.Debug(fmt.Sprintf("removing %s", path))
+		remove := os.Remove
+		if isPrivateDir(path) {
+			remove = os.RemoveAll
+		}
+		err := remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			context.warn.Printf("failed to remove %s: %v. BEWARE THAT NO CLEARTEXT FILE IS REMAINING!\n", path, err)
+			failed[path] = true
+		}
+	}
+	return failed
+}
+
+// failedUnder returns true if path or any of its parent directories failed to be removed
+func failedUnder(failed map[string]bool, path string) bool {
+	for f := range failed {
+		if path == f || strings.HasPrefix(path, f+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// processExists returns true if a process with the pid is running
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// processStartTime returns the start time of the process in clock ticks since the boot, read from /proc/<pid>/stat.
+// It is empty where procfs is unavailable, like macOS
+func processStartTime(pid int) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// The command name in the 2nd field may contain spaces and parentheses, so the fields are counted from the last ")"
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	// The start time is the 22nd field
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
+
+// processRunning returns true if the process with the pid is running and started at the start time recorded along with the pid,
+// so that another process reusing the pid of a dead sopsed process isn't taken for it.
+// Only the pid is checked when the start time is unknown, like the states written by older versions
+func processRunning(pid int, start string) bool {
+	if !processExists(pid) {
+		return false
+	}
+	if start == "" {
+		return true
+	}
+	current := processStartTime(pid)
+	return current == "" || current == start
+}
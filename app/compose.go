@@ -0,0 +1,106 @@
+package app
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// decryptedVault is the entries decrypted from the content of an encrypted vault
+type decryptedVault struct {
+	checksum [sha256.Size]byte
+	entries  map[string]*vaultEntry
+}
+
+// readVault decrypts the vault. The entries are decrypted again only when the vault changed since the last call,
+// e.g. when another sopsed process wrote back changes to it
+func (app *Job) readVault() (map[string]*vaultEntry, error) {
+	path := app.encryptedVault()
+	svcs, err := app.context.keyServices()
+	if err != nil {
+		return nil, err
+	}
+	if isPerFileVault(path) {
+		sum, err := perFileVaultChecksum(path)
+		if err != nil {
+			return nil, err
+		}
+		if app.decrypted != nil && app.decrypted.checksum == sum {
+			return app.decrypted.entries, nil
+		}
+		entries, err := decryptPerFileVault(path, svcs)
+		if err != nil {
+			return nil, err
+		}
+		app.decrypted = &decryptedVault{checksum: sum, entries: entries}
+		return entries, nil
+	}
+	encrypted, err := readVaultFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(encrypted)
+	if app.decrypted != nil && app.decrypted.checksum == sum {
+		return app.decrypted.entries, nil
+	}
+	entries, err := decryptVaultData(path, encrypted, svcs)
+	if err != nil {
+		return nil, err
+	}
+	app.decrypted = &decryptedVault{checksum: sum, entries: entries}
+	return entries, nil
+}
+
+// checkCollisions returns an error listing files and environment variables provided by more than one of the vaults,
+// so that composed vaults never overwrite each other.
+// Files collide when they are restored to the same path on the disk, which is the path in the vaults when sharing a private directory
+func checkCollisions(jobs []*Job, privateDir bool) error {
+	files := map[string][]string{}
+	// paths is the path in the vault first found for each file, shown in the message
+	paths := map[string]string{}
+	envs := map[string][]string{}
+	for _, j := range jobs {
+		entries, err := j.readVault()
+		if err != nil {
+			return err
+		}
+		for path, e := range entries {
+			if e.isEnv() {
+				envs[path] = append(envs[path], j.vaultName)
+				continue
+			}
+			file := path
+			if !privateDir {
+				file = j.pathOf(path)
+			}
+			vault := j.vaultName
+			if first, ok := paths[file]; !ok {
+				paths[file] = path
+			} else if first != path {
+				vault = fmt.Sprintf("%s (as %s)", j.vaultName, path)
+			}
+			files[file] = append(files[file], vault)
+		}
+		for _, e := range j.exports {
+			envs[e.name] = append(envs[e.name], j.vaultName)
+		}
+	}
+
+	collisions := []string{}
+	for file, vaults := range files {
+		if len(vaults) > 1 {
+			collisions = append(collisions, fmt.Sprintf("  file %s: %s", paths[file], strings.Join(vaults, ", ")))
+		}
+	}
+	for name, vaults := range envs {
+		if len(vaults) > 1 {
+			collisions = append(collisions, fmt.Sprintf("  environment variable %s: %s", name, strings.Join(vaults, ", ")))
+		}
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return fmt.Errorf("refusing to decrypt vaults providing the same files or environment variables:\n%s", strings.Join(collisions, "\n"))
+}
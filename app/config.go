@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFile is the name of the file sopsed reads additional vault definitions from
+const ConfigFile = ".sopsed.yaml"
+
+// config is the schema of .sopsed.yaml
+type config struct {
+	Vaults []vaultSpec `yaml:"vaults"`
+	// KeyServices is the endpoints of remote sops key services used for every operation on data keys
+	KeyServices []string `yaml:"keyservices"`
+}
+
+// vaultSpec is the declarative counterpart of a VaultBuilder
+type vaultSpec struct {
+	Name     string   `yaml:"name"`
+	Commands []string `yaml:"commands"`
+	Files    []string `yaml:"files"`
+	// Regexps match the paths of files stored in the vault, in addition to Files
+	Regexps []string `yaml:"regexps"`
+	// Exclude is the globs of files never stored in the vault
+	Exclude []string `yaml:"exclude"`
+	// When restricts the vault to invocations matching the rules
+	When *matchSpec `yaml:"when"`
+	// Unless excludes invocations matching any of the rules
+	Unless *matchSpec `yaml:"unless"`
+	// FlagsWithValues is the flags of the commands taking their values as separate args, which `when` and `unless` skip the values of
+	FlagsWithValues []string `yaml:"flags_with_values"`
+	// Location is the directory containing the vault, relative to the root of the git repository
+	Location string `yaml:"location"`
+	// PrivateDir restores files into a private directory instead of the working directory
+	PrivateDir bool `yaml:"private_dir"`
+	// Layout is either `single` or `per-file`, the layout a new vault is stored in
+	Layout string `yaml:"layout"`
+	// Exports is the environment variables set for the wrapped command. $SOPSED_DIR in values is expanded
+	Exports yaml.MapSlice `yaml:"exports"`
+}
+
+// matchSpec is the declarative counterpart of an argsMatcher
+type matchSpec struct {
+	Subcommands []string `yaml:"subcommands"`
+	Args        []string `yaml:"args"`
+}
+
+func (m *matchSpec) matcher() (argsMatcher, error) {
+	if m == nil {
+		return argsMatcher{}, nil
+	}
+	patterns, err := compilePatterns(m.Args...)
+	if err != nil {
+		return argsMatcher{}, err
+	}
+	return argsMatcher{subcommands: m.Subcommands, patterns: patterns}, nil
+}
+
+func (s vaultSpec) builder() (*VaultBuilder, error) {
+	for _, g := range append(append([]string{}, s.Files...), s.Exclude...) {
+		if _, err := compileGlob(strings.TrimPrefix(g, "!")); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := compilePatterns(s.Regexps...); err != nil {
+		return nil, fmt.Errorf("invalid regexp in `regexps`: %v", err)
+	}
+	b := NewVault(s.Name).UsedForCommand(s.Commands...).StoresFilesMatchingGlob(s.Files...).
+		StoresFilesMatchingRegexp(s.Regexps...).ExcludesFilesMatchingGlob(s.Exclude...)
+	used, err := s.When.matcher()
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp in `when.args`: %v", err)
+	}
+	notUsed, err := s.Unless.matcher()
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp in `unless.args`: %v", err)
+	}
+	b.used = used
+	b.notUsed = notUsed
+	b.TakesFlagsWithValues(s.FlagsWithValues...)
+	if s.Location != "" {
+		b.LocatedIn(s.Location)
+	}
+	if s.PrivateDir {
+		b.RestoresIntoPrivateDir()
+	}
+	if err := checkLayout(s.Name, s.Layout); err != nil {
+		return nil, err
+	}
+	if s.Layout == PerFileLayout {
+		b.StoresEntriesPerFile()
+	}
+	for _, e := range s.Exports {
+		name, ok := e.Key.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid name in `exports`: %v", e.Key)
+		}
+		b.ExportsEnv(name, fmt.Sprintf("%v", e.Value))
+	}
+	return b, nil
+}
+
+// LoadVaults reads vault definitions from the config file at path and merges them into presets.
+// A vault defined in the config file replaces the preset of the same name. A missing config file is not an error.
+// A relative path is searched from the working directory up to the root of the git repository
+func LoadVaults(path string, presets ...*VaultBuilder) ([]*VaultBuilder, error) {
+	loaded, err := readConfig(configPath(path))
+	if err != nil {
+		return nil, withExitCode(ExitConfigError, err)
+	}
+	return mergeVaults(presets, loaded), nil
+}
+
+// LoadKeyServices reads the endpoints of remote key services from the config file at path, searched the same way as LoadVaults
+func LoadKeyServices(path string) ([]string, error) {
+	path = configPath(path)
+	c, _, err := parseConfig(path)
+	if err != nil {
+		return nil, withExitCode(ExitConfigError, err)
+	}
+	for _, endpoint := range c.KeyServices {
+		if _, _, err := parseKeyServiceEndpoint(endpoint); err != nil {
+			return nil, withExitCode(ExitConfigError, fmt.Errorf("%s: %v", path, err))
+		}
+	}
+	return c.KeyServices, nil
+}
+
+// configPath returns the path to the config file found from the working directory up to the root of the git repository, for a relative path
+func configPath(path string) string {
+	if !filepath.IsAbs(path) {
+		if found, ok := findUp(path); ok {
+			return relPath(found)
+		}
+	}
+	return path
+}
+
+// parseConfig parses the config file at path. A missing config file results in an empty config
+func parseConfig(path string) (*config, []byte, error) {
+	src, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &config{}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var c config
+	if err := yaml.UnmarshalStrict(src, &c); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return &c, src, nil
+}
+
+func readConfig(path string) ([]*VaultBuilder, error) {
+	c, src, err := parseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := listItemLines(src, "vaults")
+	lineOf := func(i int) string {
+		if i < len(lines) {
+			return fmt.Sprintf("%s:%d", path, lines[i])
+		}
+		return fmt.Sprintf("%s: vaults[%d]", path, i)
+	}
+
+	seen := map[string]bool{}
+	builders := []*VaultBuilder{}
+	for i, s := range c.Vaults {
+		if s.Name == "" {
+			return nil, fmt.Errorf("%s: vault is missing `name`", lineOf(i))
+		}
+		if err := checkVaultName(s.Name); err != nil {
+			return nil, fmt.Errorf("%s: %v", lineOf(i), err)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("%s: vault %q is defined more than once", lineOf(i), s.Name)
+		}
+		seen[s.Name] = true
+		if len(s.Commands) == 0 {
+			return nil, fmt.Errorf("%s: vault %q must have at least one entry in `commands`", lineOf(i), s.Name)
+		}
+		if len(s.Files) == 0 && len(s.Regexps) == 0 {
+			return nil, fmt.Errorf("%s: vault %q must have at least one entry in `files` or `regexps`", lineOf(i), s.Name)
+		}
+		b, err := s.builder()
+		if err != nil {
+			return nil, fmt.Errorf("%s: vault %q: %v", lineOf(i), s.Name, err)
+		}
+		builders = append(builders, b)
+	}
+	return builders, nil
+}
+
+// mergeVaults returns presets with every vault in overrides either replacing the preset of the same name or appended
+func mergeVaults(presets []*VaultBuilder, overrides []*VaultBuilder) []*VaultBuilder {
+	merged := append([]*VaultBuilder{}, presets...)
+	for _, o := range overrides {
+		replaced := false
+		for i, p := range merged {
+			if p.vaultName == o.vaultName {
+				merged[i] = o
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
+
+// listItemLines returns the 1-based line numbers of the block sequence items under the top-level key.
+// yaml.v2 doesn't expose node positions, so this is what we use to point users at the offending vault.
+func listItemLines(src []byte, key string) []int {
+	lines := []int{}
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	inside := false
+	indent := -1
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		depth := len(line) - len(trimmed)
+		if depth == 0 && !strings.HasPrefix(trimmed, "-") {
+			inside = strings.HasPrefix(trimmed, key+":")
+			continue
+		}
+		if !inside || !(trimmed == "-" || strings.HasPrefix(trimmed, "- ")) {
+			continue
+		}
+		if indent == -1 {
+			indent = depth
+		}
+		if depth == indent {
+			lines = append(lines, n)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// backupDir is the directory containing the backups of cleartext files found at the paths files are restored to
+const backupDir = stateDir + "/backups"
+
+// existingFiles classifies the files already existing at the paths the entries are restored to,
+// into the ones identical to the entries and the ones differing from them
+func (app *Job) existingFiles(entries map[string]*vaultEntry) (identical []string, differing []string, err error) {
+	paths := []string{}
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if !fileExists(app.pathOf(p)) {
+			continue
+		}
+		expected, err := entries[p].checksum()
+		if err != nil {
+			return nil, nil, err
+		}
+		actual, err := fileChecksum(app.pathOf(p))
+		if err != nil {
+			return nil, nil, err
+		}
+		if actual == expected {
+			identical = append(identical, app.pathOf(p))
+		} else {
+			differing = append(differing, app.pathOf(p))
+		}
+	}
+	return identical, differing, nil
+}
+
+// differingFilesError explains how to deal with cleartext files that would be overwritten by decrypting the vault
+func (app *Job) differingFilesError(paths []string) error {
+	return fmt.Errorf("refusing to overwrite files differing from the ones in vault %s:\n  %s\nencrypt them with `sopsed encrypt %s`, move them away, or rerun with --force to back them up while the vault is decrypted",
+		app.vaultName, strings.Join(relPaths(paths), "\n  "), app.vaultName)
+}
+
+// backUp copies the files into backupDir and returns the map from the files to their backups.
+// The files are copied rather than moved so that they are never lost even when sopsed is killed in the middle
+func backUp(paths ...string) (map[string]string, error) {
+	backups := map[string]string{}
+	for _, p := range paths {
+		backup := statePath(filepath.Join(backupDir, fmt.Sprintf("%d", os.Getpid()), absPath(p)))
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := makeStateDir(backup); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(backup, b, info.Mode().Perm()); err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", p, err)
+		}
+		if err := os.Chtimes(backup, info.ModTime(), info.ModTime()); err != nil {
+			return nil, err
+		}
+		backups[p] = backup
+	}
+	return backups, nil
+}
+
+// putBack replaces the file at path with its backup. It returns false without touching path when the backup is already put back
+func putBack(context *Context, path string, backup string) (bool, error) {
+	if !fileExists(backup) {
+		return false, nil
+	}
+	context.Debug(fmt.Sprintf("putting back %s from %s", path, backup))
+	if err := os.Rename(backup, path); err != nil {
+		return false, err
+	}
+	// Remove the directories left empty, up to backupDir
+	for dir := filepath.Dir(backup); dir != statePath(backupDir) && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return true, nil
+}
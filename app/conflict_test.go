@@ -0,0 +1,47 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestBackUpIgnoredByGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sopsed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if out, err := exec.Command("git", "init", "-q").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	if err := ioutil.WriteFile("kubeconfig", []byte("cleartext"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := backUp("kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(backups["kubeconfig"]) {
+		t.Fatalf("kubeconfig is not backed up: %v", backups)
+	}
+
+	out, err := exec.Command("git", "status", "--porcelain", "--untracked-files=all").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git status: %v: %s", err, out)
+	}
+	if status := strings.TrimSpace(string(out)); status != "?? kubeconfig" {
+		t.Errorf("backups are not ignored by git:\n%s", status)
+	}
+}
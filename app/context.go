@@ -1,9 +1,13 @@
 package app
 
 import (
-	"fmt"
+	"errors"
+	"io"
 	"log"
 	"os"
+	"time"
+
+	"go.mozilla.org/sops/keyservice"
 )
 
 // Context contains all the execution context of this app including loggers
@@ -14,16 +18,44 @@ type Context struct {
 	warn    *log.Logger
 	debug   *log.Logger
 	Verbose bool
+	// Out is where results like the files to be encrypted by DryRun are printed, which is os.Stdout by default
+	Out io.Writer
+	// NoWriteBack disables re-encrypting files modified or created by the wrapped command into the vault
+	NoWriteBack bool
+	// WriteBackOnFailure writes back the changes made by the wrapped command even when it fails or is interrupted
+	WriteBackOnFailure bool
+	// PrivateDir restores files into a private directory instead of the working directory, for every vault
+	PrivateDir bool
+	// Force makes decrypting back up and overwrite cleartext files differing from the ones in the vault, instead of failing
+	Force bool
+	// DryRun makes encrypting print the files to be encrypted without encrypting them
+	DryRun bool
+	// Env selects the environment-specific vaults like `.sops.vault.kubectl.prod`. Empty for the default ones
+	Env string
+	// Recipients is the master keys added to or removed from vaults by rotating them
+	Recipients Recipients
+	// KeyServices is the endpoints of remote sops key services like `tcp://10.0.0.1:5000` or `unix:///run/sops.sock`, used for every operation on data keys
+	KeyServices []string
+	// LocalKeyService makes the master keys available to this process used after the remote key services
+	LocalKeyService bool
+	// keyServiceClients is the clients of the key services, connected on first use
+	keyServiceClients []keyservice.KeyServiceClient
+	// LockTimeout is how long to wait for other sopsed processes to release the lock on a vault
+	LockTimeout time.Duration
 }
 
 // NewContext returns a new context with the default loggers
 func NewContext() *Context {
 	return &Context{
-		info:    log.New(os.Stderr, "", 0),
-		err:     log.New(os.Stderr, "error: ", 0),
-		warn:    log.New(os.Stderr, "warn: ", 0),
-		debug:   log.New(os.Stderr, "debug: ", 0),
-		Verbose: os.Getenv("DEBUG") != "",
+		info:            log.New(os.Stderr, "", 0),
+		err:             log.New(os.Stderr, "error: ", 0),
+		warn:            log.New(os.Stderr, "warn: ", 0),
+		debug:           log.New(os.Stderr, "debug: ", 0),
+		Verbose:         os.Getenv("DEBUG") != "",
+		Out:             os.Stdout,
+		Env:             os.Getenv(envEnv),
+		LockTimeout:     DefaultLockTimeout,
+		LocalKeyService: true,
 	}
 }
 
@@ -41,6 +73,12 @@ func (c *Context) Info(msg string) {
 	}
 }
 
+// Infof prints an info message regardless of the verbose-logging, like the progress of sopsed.
+// It goes to stderr along with the other logs, so that it never mixes into the output of the wrapped command
+func (c *Context) Infof(format string, v ...interface{}) {
+	c.info.Printf(format, v...)
+}
+
 // Warn prints a warn message
 func (c *Context) Warn(msg string) {
 	if c.Verbose {
@@ -48,8 +86,14 @@ func (c *Context) Warn(msg string) {
 	}
 }
 
-// ExitWithError os.Exit with an error
-func (c *Context) ExitWithError(err error) {
-	c.err.Println(fmt.Sprintf("%v", err))
-	os.Exit(1)
+// PrintError prints the error along with the code and the hint of the typed error in it, if any.
+// The failure of the wrapped command in a CommandExitError is printed only when the verbose-logging is enabled,
+// as the command is responsible for reporting its own failure
+func (c *Context) PrintError(err error) {
+	var exitErr *CommandExitError
+	if errors.As(err, &exitErr) {
+		c.Debug(err.Error())
+		return
+	}
+	c.err.Println(describeError(err))
 }
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// readDotenv parses a dotenv file made of `KEY=value` lines.
+// Blank lines, `#` comments and the `export ` prefix are ignored. Values may be single-quoted verbatim, or double-quoted with Go escape sequences
+func readDotenv(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		key := strings.TrimSpace(kv[0])
+		if !envNamePattern.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: invalid variable name %q", path, n, key)
+		}
+		value, err := dotenvValue(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func dotenvValue(raw string) (string, error) {
+	switch {
+	case len(raw) >= 2 && strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'"):
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, `"`):
+		v, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted value: %v", err)
+		}
+		return v, nil
+	default:
+		// Strip trailing comments from unquoted values
+		if i := strings.Index(raw, " #"); i >= 0 {
+			raw = strings.TrimSpace(raw[:i])
+		}
+		return raw, nil
+	}
+}
@@ -0,0 +1,259 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mozilla.org/sops"
+	"go.mozilla.org/sops/keyservice"
+)
+
+// envKind is the kind of entries exposed to the wrapped command as environment variables rather than files.
+// The key of such an entry is the name of the variable
+const envKind = "env"
+
+// base64Encoding is the encoding of entries whose content isn't valid UTF-8 and therefore can't survive a JSON round trip as-is
+const base64Encoding = "base64"
+
+const (
+	defaultFileMode       os.FileMode = 0644
+	defaultPrivateKeyMode os.FileMode = 0600
+)
+
+// vaultEntry is a file stored in a vault along with its metadata.
+// Vaults written by older versions of sopsed store the content as a plain string instead, which is read as an entry without metadata
+type vaultEntry struct {
+	// Kind is either empty for a file or envKind for an environment variable
+	Kind    string `json:"kind,omitempty"`
+	Content string `json:"content"`
+	// Encoding is how Content is encoded. Empty when Content is the verbatim content of the file
+	Encoding string `json:"encoding,omitempty"`
+	// Mode is the octal permission bits of the file like "0600". Empty when unknown
+	Mode string `json:"mode,omitempty"`
+	// ModTime is the RFC3339 modification time of the file. Empty when unknown
+	ModTime string `json:"mtime,omitempty"`
+}
+
+// newVaultEntry reads the file at path into an entry
+func newVaultEntry(path string) (*vaultEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &vaultEntry{
+		Content: string(raw),
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModTime: info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+	if !utf8.Valid(raw) {
+		e.Content = base64.StdEncoding.EncodeToString(raw)
+		e.Encoding = base64Encoding
+	}
+	return e, nil
+}
+
+// newEnvEntry returns an entry for an environment variable with the value
+func newEnvEntry(value string) *vaultEntry {
+	return &vaultEntry{Kind: envKind, Content: value}
+}
+
+func (e *vaultEntry) isEnv() bool {
+	return e.Kind == envKind
+}
+
+// bytes returns the decoded content of the entry
+func (e *vaultEntry) bytes() ([]byte, error) {
+	switch e.Encoding {
+	case "":
+		return []byte(e.Content), nil
+	case base64Encoding:
+		return base64.StdEncoding.DecodeString(e.Content)
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", e.Encoding)
+	}
+}
+
+// checksum returns the hex-encoded SHA-256 hash of the decoded content
+func (e *vaultEntry) checksum() (string, error) {
+	content, err := e.bytes()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(content)), nil
+}
+
+// fileChecksum returns the hex-encoded SHA-256 hash of the file at path
+func fileChecksum(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(content)), nil
+}
+
+func (e *vaultEntry) UnmarshalJSON(data []byte) error {
+	var content string
+	if err := json.Unmarshal(data, &content); err == nil {
+		*e = vaultEntry{Content: content}
+		return nil
+	}
+	type plain vaultEntry
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*e = vaultEntry(p)
+	return nil
+}
+
+// fileMode returns the recorded mode of the entry, or the default one for the path when it is unknown
+func (e *vaultEntry) fileMode(path string) (os.FileMode, error) {
+	if e.Mode == "" {
+		content, err := e.bytes()
+		if err != nil {
+			return 0, err
+		}
+		if looksLikePrivateKey(path, string(content)) {
+			return defaultPrivateKeyMode, nil
+		}
+		return defaultFileMode, nil
+	}
+	m, err := strconv.ParseUint(e.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q for %s: %v", e.Mode, path, err)
+	}
+	return os.FileMode(m).Perm(), nil
+}
+
+// restore writes the entry to path, restoring its mode and modification time
+func (e *vaultEntry) restore(path string) error {
+	mode, err := e.fileMode(path)
+	if err != nil {
+		return err
+	}
+	content, err := e.bytes()
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(path, content, mode); err != nil {
+		return err
+	}
+	// WriteFile doesn't change the mode of an existing file, and the mode of a new file is subject to umask
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if e.ModTime != "" {
+		mtime, err := time.Parse(time.RFC3339Nano, e.ModTime)
+		if err != nil {
+			return fmt.Errorf("invalid mtime %q for %s: %v", e.ModTime, path, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *vaultEntry) treeBranch() sops.TreeBranch {
+	branch := sops.TreeBranch{}
+	if e.Kind != "" {
+		branch = append(branch, sops.TreeItem{Key: "kind", Value: e.Kind})
+	}
+	branch = append(branch, sops.TreeItem{Key: "content", Value: e.Content})
+	if e.Encoding != "" {
+		branch = append(branch, sops.TreeItem{Key: "encoding", Value: e.Encoding})
+	}
+	if e.Mode != "" {
+		branch = append(branch, sops.TreeItem{Key: "mode", Value: e.Mode})
+	}
+	if e.ModTime != "" {
+		branch = append(branch, sops.TreeItem{Key: "mtime", Value: e.ModTime})
+	}
+	return branch
+}
+
+// looksLikePrivateKey returns true if the file seems to contain a private key, which must not be readable by others
+func looksLikePrivateKey(path string, content string) bool {
+	base := filepath.Base(path)
+	for _, p := range []string{"*-key.pem", "*.key", "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519"} {
+		if matched, _ := filepath.Match(p, base); matched {
+			return true
+		}
+	}
+	return strings.Contains(content, "PRIVATE KEY-----")
+}
+
+// fileEntries returns the entries stored as files, excluding environment variables
+func fileEntries(entries map[string]*vaultEntry) map[string]*vaultEntry {
+	files := map[string]*vaultEntry{}
+	for k, e := range entries {
+		if !e.isEnv() {
+			files[k] = e
+		}
+	}
+	return files
+}
+
+// environ returns the environment variables stored in the entries in the form of "KEY=value", sorted by key
+func environ(entries map[string]*vaultEntry) []string {
+	env := []string{}
+	for k, e := range entries {
+		if e.isEnv() {
+			env = append(env, fmt.Sprintf("%s=%s", k, e.Content))
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// decryptVault decrypts the sops-encrypted vault at path into entries keyed by their paths, in either of the layouts
+func decryptVault(path string, svcs []keyservice.KeyServiceClient) (map[string]*vaultEntry, error) {
+	if isPerFileVault(path) {
+		return decryptPerFileVault(path, svcs)
+	}
+	encrypted, err := readVaultFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decryptVaultData(path, encrypted, svcs)
+}
+
+// readVaultFile reads a file a vault consists of, returning a FileNotFoundError when it is missing
+func readVaultFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, &FileNotFoundError{Path: path}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", relPath(path), err)
+	}
+	return b, nil
+}
+
+// decryptVaultData decrypts the content of the vault at path
+func decryptVaultData(path string, encrypted []byte, svcs []keyservice.KeyServiceClient) (map[string]*vaultEntry, error) {
+	jsonBytes, err := decryptJSON(path, encrypted, svcs)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*vaultEntry{}
+	if err := json.Unmarshal(jsonBytes, &entries); err != nil {
+		return nil, &CorruptedVaultError{Path: path, Err: err}
+	}
+	delete(entries, "sops")
+	return entries, nil
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envEnv is the environment variable selecting the environment-specific vaults, overridden by --env
+const envEnv = "SOPSED_ENV"
+
+// encryptedVaultPrefix is the prefix of the names of encrypted vaults
+const encryptedVaultPrefix = ".sops.vault."
+
+var vaultEnvPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// encryptedVault returns the path to the vault for the environment selected by Context.Env.
+// An existing vault is used in whichever layout it is stored in, and a new vault is stored in the configured layout
+func (app *Job) encryptedVault() string {
+	single := filepath.Join(app.root, app.encryptedVaultFor(app.context.Env))
+	perFile := filepath.Join(app.root, app.perFileVaultFor(app.context.Env))
+	switch {
+	case vaultExists(perFile):
+		return perFile
+	case vaultExists(single):
+		return single
+	case app.layout == PerFileLayout:
+		return perFile
+	}
+	return single
+}
+
+// checkVaultName returns an error if the vault name can't be a part of the name of a vault.
+// It shares the pattern with environments, as `.` separates them in names like `.sops.vault.kubectl.prod`
+func checkVaultName(name string) error {
+	if !vaultEnvPattern.MatchString(name) {
+		return fmt.Errorf("invalid vault name %q: it must consist of alphanumerics, `-` and `_`", name)
+	}
+	return nil
+}
+
+// checkEnv returns an error if the environment name can't be a part of the name of a vault
+func checkEnv(env string) error {
+	if env != "" && !vaultEnvPattern.MatchString(env) {
+		return fmt.Errorf("invalid environment %q: it must consist of alphanumerics, `-` and `_`", env)
+	}
+	return nil
+}
+
+// envs returns the environments the vault in dir is encrypted for, in either of the layouts. The default vault is represented by an empty string
+func (c *VaultConfig) envs(dir string) ([]string, error) {
+	found := map[string]bool{}
+	for _, prefix := range []string{c.encryptedVaultFor(""), c.perFileVaultFor("")} {
+		prefix = filepath.Join(dir, prefix)
+		if vaultExists(prefix) {
+			found[""] = true
+		}
+		matches, err := filepath.Glob(prefix + ".*")
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			env := strings.TrimPrefix(m, prefix+".")
+			if vaultEnvPattern.MatchString(env) && vaultExists(m) {
+				found[env] = true
+			}
+		}
+	}
+	envs := []string{}
+	for env := range found {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	return envs, nil
+}
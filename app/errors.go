@@ -0,0 +1,169 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error is implemented by the typed errors of sopsed, which library users can branch on with errors.As:
+//
+//	var e app.Error
+//	if errors.As(err, &e) && e.Code() == app.CodeExpiredCredentials { ... }
+type Error interface {
+	error
+	// Code returns the stable identifier of the kind of the failure
+	Code() string
+	// Hint returns how to fix the failure
+	Hint() string
+}
+
+// Stable codes of the typed errors
+const (
+	CodeSopsConfigNotFound = "SOPS_CONFIG_NOT_FOUND"
+	CodeNoCreationRule     = "NO_CREATION_RULE"
+	CodeKeyAccessDenied    = "KEY_ACCESS_DENIED"
+	CodeExpiredCredentials = "EXPIRED_CREDENTIALS"
+	CodeMacMismatch        = "MAC_MISMATCH"
+	CodeCorruptedVault     = "CORRUPTED_VAULT"
+	CodeFileNotFound       = "FILE_NOT_FOUND"
+)
+
+// SopsConfigNotFoundError is returned when no .sops.yaml is found for a vault to be encrypted
+type SopsConfigNotFoundError struct {
+	// Dir is the directory .sops.yaml was searched from
+	Dir string
+}
+
+func (e *SopsConfigNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found in %s or any of its parents", sopsConfigFile, relPath(e.Dir))
+}
+
+func (e *SopsConfigNotFoundError) Code() string { return CodeSopsConfigNotFound }
+
+func (e *SopsConfigNotFoundError) Hint() string {
+	return fmt.Sprintf("create %s with creation rules following https://github.com/mumoshu/sopsed#pre-requisite", sopsConfigFile)
+}
+
+// NoCreationRuleError is returned when none of the creation rules in .sops.yaml matches a vault
+type NoCreationRuleError struct {
+	// Config is the path to .sops.yaml
+	Config string
+	// Path is the path to the vault relative to Config
+	Path string
+}
+
+func (e *NoCreationRuleError) Error() string {
+	return fmt.Sprintf("no creation rule in %s matches %s", relPath(e.Config), e.Path)
+}
+
+func (e *NoCreationRuleError) Code() string { return CodeNoCreationRule }
+
+func (e *NoCreationRuleError) Hint() string {
+	return fmt.Sprintf("add a creation rule whose filename_regex matches %s, or one without filename_regex as the last rule, to %s", e.Path, relPath(e.Config))
+}
+
+// KeyAccessDeniedError is returned when none of the master keys could encrypt or decrypt the data key of a vault
+type KeyAccessDeniedError struct {
+	// Keys is the master keys tried, like KMS ARNs and PGP fingerprints
+	Keys []string
+	Err  error
+}
+
+func (e *KeyAccessDeniedError) Error() string {
+	return fmt.Sprintf("no access to the master keys %s: %v", strings.Join(e.Keys, ", "), e.Err)
+}
+
+func (e *KeyAccessDeniedError) Unwrap() error { return e.Err }
+
+func (e *KeyAccessDeniedError) Code() string { return CodeKeyAccessDenied }
+
+func (e *KeyAccessDeniedError) Hint() string {
+	return "make sure you are allowed to use any of the master keys, e.g. by importing the PGP key or by being granted kms:Decrypt, or ask someone who is to run `sopsed keys add` for you"
+}
+
+// ExpiredCredentialsError is returned when the cloud credentials used to access the master keys have expired
+type ExpiredCredentialsError struct {
+	Err error
+}
+
+func (e *ExpiredCredentialsError) Error() string {
+	return fmt.Sprintf("credentials have expired: %v", e.Err)
+}
+
+func (e *ExpiredCredentialsError) Unwrap() error { return e.Err }
+
+func (e *ExpiredCredentialsError) Code() string { return CodeExpiredCredentials }
+
+func (e *ExpiredCredentialsError) Hint() string {
+	return "refresh your credentials, e.g. by logging in to aws again, and retry"
+}
+
+// MacMismatchError is returned when the MAC of a vault doesn't match its content, which means the vault was modified by something other than sops
+type MacMismatchError struct {
+	Path string
+}
+
+func (e *MacMismatchError) Error() string {
+	return fmt.Sprintf("failed to verify the integrity of %s: the mac doesn't match the content", relPath(e.Path))
+}
+
+func (e *MacMismatchError) Code() string { return CodeMacMismatch }
+
+func (e *MacMismatchError) Hint() string {
+	return fmt.Sprintf("%s was modified without sops, e.g. by a bad merge. restore it from git history, like `git checkout -- %s`", relPath(e.Path), relPath(e.Path))
+}
+
+// CorruptedVaultError is returned when a vault can't be parsed or its values can't be decrypted with its data key
+type CorruptedVaultError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptedVaultError) Error() string {
+	return fmt.Sprintf("%s is corrupted: %v", relPath(e.Path), e.Err)
+}
+
+func (e *CorruptedVaultError) Unwrap() error { return e.Err }
+
+func (e *CorruptedVaultError) Code() string { return CodeCorruptedVault }
+
+func (e *CorruptedVaultError) Hint() string {
+	return fmt.Sprintf("resolve merge conflicts in %s if any, or restore it from git history", relPath(e.Path))
+}
+
+// FileNotFoundError is returned when a vault or a file a vault consists of is missing
+type FileNotFoundError struct {
+	Path string
+}
+
+func (e *FileNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found", relPath(e.Path))
+}
+
+func (e *FileNotFoundError) Code() string { return CodeFileNotFound }
+
+func (e *FileNotFoundError) Hint() string {
+	return fmt.Sprintf("encrypt files into the vault with `sopsed encrypt`, or restore %s from git history", relPath(e.Path))
+}
+
+// dataKeyAccessError classifies the failure of the master keys to encrypt or decrypt a data key.
+// sops doesn't type the errors of master keys, so expired credentials are told by the messages of the cloud providers
+func dataKeyAccessError(keys []string, err error) error {
+	msg := err.Error()
+	for _, expired := range []string{"ExpiredToken", "security token included in the request is expired", "oauth2: token expired"} {
+		if strings.Contains(msg, expired) {
+			return &ExpiredCredentialsError{Err: err}
+		}
+	}
+	return &KeyAccessDeniedError{Keys: keys, Err: err}
+}
+
+// describeError returns the message of the error along with the code and the hint of the typed error in it, if any
+func describeError(err error) string {
+	var e Error
+	if !errors.As(err, &e) {
+		return err.Error()
+	}
+	return fmt.Sprintf("[%s] %v\nhint: %s", e.Code(), err, e.Hint())
+}
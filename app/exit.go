@@ -0,0 +1,134 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Exit codes for failures of sopsed itself.
+// `sopsed run` exits with the exit code of the wrapped command, or 128+N when the command was killed by the signal N.
+// sopsed's own failures use the range 200-209, which is unlikely to collide with ones returned by the wrapped commands
+const (
+	// ExitFailure is for failures not covered by the more specific exit codes below
+	ExitFailure = 200
+	// ExitConfigError means .sopsed.yaml or .sops.yaml is invalid
+	ExitConfigError = 201
+	// ExitNoVault means no vault is configured for the vault name or the command
+	ExitNoVault = 202
+	// ExitDecryptFailure means sopsed failed to decrypt a vault or to restore files from it
+	ExitDecryptFailure = 203
+	// ExitEncryptFailure means sopsed failed to encrypt files into a vault
+	ExitEncryptFailure = 204
+	// ExitVerifyFailure means files on the disk are missing or differ from the ones in the vault
+	ExitVerifyFailure = 205
+	// ExitUsageError means the command-line args given to sopsed are invalid, like an unknown flag
+	ExitUsageError = 206
+)
+
+const (
+	// exitCommandNotExecutable is the exit code of shells for a command found but not executable
+	exitCommandNotExecutable = 126
+	// exitCommandNotFound is the exit code of shells for a command not found
+	exitCommandNotFound = 127
+	// exitSignalOffset is added to the signal number to compute the exit code of a command killed by a signal
+	exitSignalOffset = 128
+)
+
+// exitCoder is implemented by errors that determine the exit code of the process
+type exitCoder interface {
+	ExitCode() int
+}
+
+// ExitCode returns the exit code the process should exit with for the error returned by App, or 0 for nil
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodeOf(err)
+}
+
+// exitCodeOf returns the exit code the process should exit with for the error
+func exitCodeOf(err error) int {
+	var e exitCoder
+	if errors.As(err, &e) {
+		return e.ExitCode()
+	}
+	return ExitFailure
+}
+
+// codedError is an error of sopsed itself, annotated with an exit code
+type codedError struct {
+	code int
+	err  error
+}
+
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e exitCoder
+	if errors.As(err, &e) {
+		return err
+	}
+	return &codedError{code: code, err: err}
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode returns the exit code for the error
+func (e *codedError) ExitCode() int {
+	return e.code
+}
+
+// CommandExitError is returned when the wrapped command exits with a non-zero exit code or is killed by a signal
+type CommandExitError struct {
+	Command string
+	// Code is the exit code of the command, or 128+N when it was killed by the signal N
+	Code int
+}
+
+func (e *CommandExitError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.Command, e.Code)
+}
+
+// ExitCode returns the exit code of the wrapped command
+func (e *CommandExitError) ExitCode() int {
+	return e.Code
+}
+
+// commandExitError converts the error returned by exec.Cmd.Wait into a CommandExitError, preserving the exit code
+func commandExitError(command string, err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("failed running %s: %v", command, err)
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return fmt.Errorf("failed running %s: %v", command, err)
+	}
+	if status.Signaled() {
+		return &CommandExitError{Command: command, Code: exitSignalOffset + int(status.Signal())}
+	}
+	return &CommandExitError{Command: command, Code: status.ExitStatus()}
+}
+
+// commandStartError annotates the error returned by exec.Cmd.Start with the exit code shells use for the same failure
+func commandStartError(command string, err error) error {
+	code := exitCommandNotExecutable
+	if e, ok := err.(*exec.Error); ok && e.Err == exec.ErrNotFound {
+		code = exitCommandNotFound
+	}
+	if os.IsNotExist(err) {
+		code = exitCommandNotFound
+	}
+	return withExitCode(code, fmt.Errorf("failed running %s: %v", command, err))
+}
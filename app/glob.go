@@ -0,0 +1,124 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// skippedDirs are never searched for files matching `**` globs and regexps
+var skippedDirs = map[string]bool{".git": true, ".sopsed": true}
+
+// compileGlob converts a glob into a regexp matching slash-separated paths.
+// In addition to the syntax of filepath.Match, `**` matches any number of directories
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid glob %q: unterminated character class", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") || strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			buf.WriteString(regexp.QuoteMeta(string(glob[i+1])))
+			i++
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	r, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+	return r, nil
+}
+
+// globBase returns the leading directories of the glob free of wildcards, from which files matching it are searched
+func globBase(glob string) string {
+	segments := strings.Split(glob, "/")
+	base := []string{}
+	for _, s := range segments[:len(segments)-1] {
+		if strings.ContainsAny(s, `*?[\`) {
+			break
+		}
+		base = append(base, s)
+	}
+	if len(base) == 0 {
+		return "."
+	}
+	return strings.Join(base, "/")
+}
+
+// walkFiles returns the slash-separated paths of the regular files under base relative to dir, which match r
+func walkFiles(dir string, base string, r *regexp.Regexp) ([]string, error) {
+	root := filepath.Join(dir, filepath.FromSlash(base))
+	if dir == "" {
+		root = filepath.FromSlash(base)
+	}
+	files := []string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != root && skippedDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel := p
+		if dir != "" {
+			if rel, err = filepath.Rel(dir, p); err != nil {
+				return err
+			}
+		}
+		rel = filepath.ToSlash(rel)
+		if r.MatchString(rel) {
+			files = append(files, filepath.FromSlash(rel))
+		}
+		return nil
+	})
+	if err == filepath.SkipDir {
+		err = nil
+	}
+	return files, err
+}
+
+// excluded returns true if the slash-separated path matches the exclude pattern.
+// A pattern without `/` is matched against the base name of the path, like .gitignore
+func excluded(p string, exclude *regexp.Regexp, matchesBase bool) bool {
+	if matchesBase {
+		return exclude.MatchString(path.Base(p))
+	}
+	return exclude.MatchString(p)
+}
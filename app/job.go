@@ -1,15 +1,16 @@
 package app
 
 import (
+	"context"
 	"strings"
 
-	"go.mozilla.org/sops/decrypt"
-
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"syscall"
 )
 
 func fileExists(filename string) bool {
@@ -20,31 +21,62 @@ func fileExists(filename string) bool {
 type Job struct {
 	*VaultConfig
 	context *Context
+	// root is the directory containing the vault, which files in the vault are relative to
+	root string
+	// dir is the private directory files are restored into and written back from. Empty for root
+	dir string
+	// sharesDir is true when dir is a private directory removed by another job
+	sharesDir bool
+	// decrypted caches the entries in the vault, so that composed vaults are decrypted only once
+	decrypted *decryptedVault
+}
+
+// pathOf returns the path on the disk of the file stored at path in the vault
+func (app *Job) pathOf(path string) string {
+	return filepath.Join(app.base(), path)
+}
+
+// base returns the directory files are restored into and written back from
+func (app *Job) base() string {
+	if app.dir == "" {
+		return app.root
+	}
+	return app.dir
+}
+
+// pathsOf returns the paths on the disk of the files stored at paths in the vault
+func (app *Job) pathsOf(paths ...string) []string {
+	ret := []string{}
+	for _, p := range paths {
+		ret = append(ret, app.pathOf(p))
+	}
+	return ret
 }
 
 type assets struct {
-	files   map[string]string
+	// dir is the directory the paths of files are relative to
+	dir     string
+	files   map[string]*vaultEntry
 	paths   []string
 	context *Context
 }
 
 func readAssetsFromFile(encryptedVault string, context *Context) (*assets, error) {
-	filesInVault := map[string]string{}
+	filesInVault := map[string]*vaultEntry{}
 	filepathesInVault := []string{}
-	encryptedVaultExists := fileExists(encryptedVault)
+	encryptedVaultExists := vaultExists(encryptedVault)
 	if encryptedVaultExists {
 		// TODO shell-out rather than using sops as a library, so that we can easily supress logs from the library
-		jsonBytes, err := decrypt.File(encryptedVault, "json")
+		svcs, err := context.keyServices()
 		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt %s: %v", encryptedVault, err)
+			return nil, err
 		}
-		if err := json.Unmarshal(jsonBytes, &filesInVault); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal %s: %v", encryptedVault, err)
+		filesInVault, err = decryptVault(encryptedVault, svcs)
+		if err != nil {
+			return nil, err
 		}
 		for k := range filesInVault {
-			if k != "sops" {
-				filepathesInVault = append(filepathesInVault, k)
-			}
+			filepathesInVault = append(filepathesInVault, k)
 		}
 	}
 	return &assets{
@@ -54,90 +86,114 @@ func readAssetsFromFile(encryptedVault string, context *Context) (*assets, error
 	}, nil
 }
 
-func (a *assets) writeToFile(unencryptedVault string, encryptedVault string) error {
-	// We don't use `sops --set key value` here so that we won't expose sensitive values in the process list
-	cleartextFilesInJSON, err := json.Marshal(a.files)
+func (a *assets) writeToFile(encryptedVault string) error {
+	// We encrypt in-process rather than `sops --encrypt`-ing a temporary file so that no cleartext is ever written to the disk
+	svcs, err := a.context.keyServices()
 	if err != nil {
 		return err
 	}
-
-	defer a.cleanup(unencryptedVault)
-	if err := ioutil.WriteFile(unencryptedVault, cleartextFilesInJSON, 0644); err != nil {
-		return err
+	var out []byte
+	if isPerFileVault(encryptedVault) {
+		err = writePerFileVault(encryptedVault, a.files, svcs)
+	} else {
+		var previous []byte
+		if vaultExists(encryptedVault) {
+			if previous, err = ioutil.ReadFile(encryptedVault); err != nil {
+				return err
+			}
+		}
+		out, err = encryptFiles(a.files, encryptedVault, previous, svcs)
 	}
-
-	out, err := runAndCaptureStdout(a.context, "sh", "-c", fmt.Sprintf("sops --encrypt --input-type json %s", unencryptedVault))
 	if err != nil {
-		if strings.Contains(err.Error(), "config file not found and no keys provided through command line options") {
-			a.context.Debug(err.Error())
-			return fmt.Errorf("`sops --encrypt` failed: .sops.yaml seems to be missing. please create one following the steps in readme(https://github.com/mumoshu/sopsed)")
-		}
-		if strings.Contains(err.Error(), "Failed to call KMS encryption service: ExpiredTokenException: The security token included in the request is expired") {
-			a.context.Debug(err.Error())
-			return fmt.Errorf("`sops --encrypt` failed: aws credentials seem to be missing or expired")
-		}
-		return err
+		return fmt.Errorf("failed to encrypt %s: %w", relPath(encryptedVault), err)
 	}
 
-	if err := ioutil.WriteFile(encryptedVault, []byte(out), 0644); err != nil {
+	if isPerFileVault(encryptedVault) {
+		return nil
+	}
+	if err := ioutil.WriteFile(encryptedVault, out, 0644); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (a *assets) addFilesMatchingPatterns(insecureFilePatterns []entry) (*assets, []string, error) {
+func (a *assets) addFilesMatchingPatterns(files []string) (*assets, []string, error) {
 	newlyRecognizedFiles := []string{}
-	for _, e := range insecureFilePatterns {
-		files, err := filepath.Glob(e.pathPattern)
+	for _, f := range files {
+		a.context.info.Printf("found %s\n", f)
+		alreadyEncrypted := false
+		for _, path := range a.paths {
+			if path == f {
+				alreadyEncrypted = true
+			}
+		}
+		if alreadyEncrypted {
+			a.context.Debug(fmt.Sprintf("skipping %s: already encrypted. you can safely remove it", f))
+		} else {
+			a.context.Debug(fmt.Sprintf("adding %s to the vault", f))
+		}
+		e, err := newVaultEntry(filepath.Join(a.dir, f))
 		if err != nil {
 			return nil, []string{}, err
 		}
-		for _, f := range files {
-			fmt.Printf("found %s\n", f)
-			alreadyEncrypted := false
-			for _, path := range a.paths {
-				if path == f {
-					alreadyEncrypted = true
-				}
-			}
-			if alreadyEncrypted {
-				a.context.Debug(fmt.Sprintf("skipping %s: already encrypted. you can safely remove it", f))
-			} else {
-				a.context.Debug(fmt.Sprintf("adding %s to the vault", f))
-			}
-			raw, err := ioutil.ReadFile(f)
-			if err != nil {
-				return nil, []string{}, err
-			}
-			a.files[f] = string(raw)
-			newlyRecognizedFiles = append(newlyRecognizedFiles, f)
-		}
+		a.files[f] = e
+		newlyRecognizedFiles = append(newlyRecognizedFiles, f)
 	}
 	return a, newlyRecognizedFiles, nil
 }
 
-func (app *Job) Encrypt() error {
+// Encrypt files matching the globs into the vault
+func (app *Job) Encrypt(ctx context.Context) error {
+	if app.context.DryRun {
+		return withExitCode(ExitEncryptFailure, app.encrypt())
+	}
+	unlock, err := app.lockVault(ctx, "encrypting")
+	if err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	defer unlock()
+	if err := app.inUse(); err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	return withExitCode(ExitEncryptFailure, app.encrypt())
+}
+
+func (app *Job) encrypt() error {
 	context := app.context
-	unencryptedVault := app.unencryptedVault()
 	encryptedVault := app.encryptedVault()
 	insecureFilePatterns := app.entries
 
-	assets, err := readAssetsFromFile(encryptedVault, context)
+	files, err := app.filesMatchingGlobs(app.root)
+	if err != nil {
+		return err
+	}
+
+	if context.DryRun {
+		for _, f := range files {
+			fmt.Fprintf(context.Out, "would encrypt %s into %s\n", relPath(app.pathOf(f)), relPath(encryptedVault))
+		}
+		if len(files) == 0 {
+			context.info.Printf("no file matches the vault %s\n", app.vaultName)
+		}
+		return nil
+	}
 
+	assets, err := readAssetsFromFile(encryptedVault, context)
 	if err != nil {
 		return err
 	}
+	assets.dir = app.root
 
 	var newlyRecognizedFiles []string
 
-	assets, newlyRecognizedFiles, err = assets.addFilesMatchingPatterns(insecureFilePatterns)
+	assets, newlyRecognizedFiles, err = assets.addFilesMatchingPatterns(files)
 
 	if err != nil {
 		return err
 	}
 
 	if len(assets.files) > 0 {
-		if err := assets.writeToFile(unencryptedVault, encryptedVault); err != nil {
+		if err := assets.writeToFile(encryptedVault); err != nil {
 			return err
 		}
 	} else {
@@ -145,11 +201,15 @@ func (app *Job) Encrypt() error {
 		for _, p := range insecureFilePatterns {
 			patterns = append(patterns, fmt.Sprintf(`"%s"`, p.pathPattern))
 		}
-		return fmt.Errorf("you must have \"%s\" or files matching any of [%s] to run %s", encryptedVault, strings.Join(patterns, ", "), app.vaultName)
+		for _, r := range app.regexps {
+			patterns = append(patterns, fmt.Sprintf(`/%s/`, r))
+		}
+		return fmt.Errorf("you must have \"%s\" or files matching any of [%s] to run %s", relPath(encryptedVault), strings.Join(patterns, ", "), app.vaultName)
 	}
 
 	for _, path := range newlyRecognizedFiles {
-		context.Info(fmt.Sprintf("renaming %s to %s.bak: it is already encrypted into %s. you can safely remove it", path, path, encryptedVault))
+		path = app.pathOf(path)
+		context.Info(fmt.Sprintf("renaming %s to %s.bak: it is already encrypted into %s. you can safely remove it", relPath(path), relPath(path), relPath(encryptedVault)))
 		err := os.Rename(path, fmt.Sprintf("%s.bak", path))
 		if err != nil {
 			return err
@@ -159,18 +219,44 @@ func (app *Job) Encrypt() error {
 	return nil
 }
 
-func (app *Job) Decrypt() (func(), error) {
+// Decrypt restores the files in the vault and returns a func to remove them
+func (app *Job) Decrypt(ctx context.Context) (func(), error) {
+	unlock, err := app.lockVault(ctx, "decrypting")
+	if err != nil {
+		return nil, withExitCode(ExitDecryptFailure, err)
+	}
+	defer unlock()
+	if err := app.inUse(); err != nil {
+		return nil, withExitCode(ExitDecryptFailure, err)
+	}
+	entries, c, err := app.decrypt(false, nil)
+	if err != nil {
+		return nil, withExitCode(ExitDecryptFailure, err)
+	}
+	// The files are decrypted on purpose now, and must not be removed as the leftovers of interrupted runs restored the same files
+	paths := []string{}
+	for path := range fileEntries(entries) {
+		paths = append(paths, app.pathOf(path))
+	}
+	if err := forgetLeftovers(app.context, paths...); err != nil {
+		app.context.warn.Printf("failed to update %s: %v\n", journalFile, err)
+	}
+	return c.run, nil
+}
+
+// decrypt restores the files in the vault and returns all the entries in it including environment variables.
+// When track is true, the restored files are recorded before being written
+// so that they are removed even when this process is interrupted before cleaning up.
+// users is the state shared with other sopsed processes using the restored files, if any.
+// When it has other users, the files are already restored by another sopsed process and only missing ones are restored
+func (app *Job) decrypt(track bool, users *vaultUsers) (map[string]*vaultEntry, *cleanup, error) {
 	context := app.context
-	encryptedVault := app.encryptedVault()
 
-	jsonBytes, err := decrypt.File(encryptedVault, "json")
+	entries, err := app.readVault()
 	if err != nil {
-		return nil, err
-	}
-	var restoredFiles map[string]string
-	if err := json.Unmarshal(jsonBytes, &restoredFiles); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	restoredFiles := fileEntries(entries)
 
 	restoredFilePathes := []string{}
 
@@ -178,51 +264,523 @@ func (app *Job) Decrypt() (func(), error) {
 		restoredFilePathes = append(restoredFilePathes, path)
 	}
 
-	for path, content := range restoredFiles {
-		context.Debug(fmt.Sprintf("restoring %s", path))
-		err := ioutil.WriteFile(path, []byte(content), 0644)
+	c := newCleanup(context, app.vaultName, app.pathsOf(restoredFilePathes...)...)
+	if app.dir != "" {
+		// Wiping the private directory also removes the files written back or created by the wrapped command
+		c = newCleanup(context, app.vaultName, app.dir)
+		if app.sharesDir {
+			c = newCleanup(context, app.vaultName)
+		}
+	}
+	for path, e := range restoredFiles {
+		sum, err := e.checksum()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		c.checksums[app.pathOf(path)] = sum
+	}
+
+	// Never lose cleartext files existed before restoring, which may be newer than the ones in the vault
+	joining := users != nil && len(users.Pids) > 0
+	kept := map[string]bool{}
+	if joining {
+		for _, p := range users.Kept {
+			kept[p] = true
+		}
+		c.keep(users.Kept...)
+		c.backups = users.Backups
+	} else {
+		identical, differing, err := app.existingFiles(restoredFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range identical {
+			context.info.Printf("leaving %s as-is, which is identical to the one in vault %s\n", relPath(p), app.vaultName)
+			kept[p] = true
+		}
+		c.keep(identical...)
+		if len(differing) > 0 {
+			if !context.Force {
+				return nil, nil, app.differingFilesError(differing)
+			}
+			backups, err := backUp(differing...)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, p := range differing {
+				if track {
+					context.warn.Printf("%s differs from the one in vault %s. backed up to %s, which is put back after the command exits\n", relPath(p), app.vaultName, relPath(backups[p]))
+				} else {
+					context.warn.Printf("%s differs from the one in vault %s. backed up to %s\n", relPath(p), app.vaultName, relPath(backups[p]))
+				}
+			}
+			c.backups = backups
+		}
+		if users != nil {
+			users.Kept = identical
+			users.Backups = c.backups
+		}
+	}
+
+	if track {
+		if err := c.track(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// On failure, remove only the files restored by this process, as the others may be in use by other processes
+	restoredByUs := []string{}
+	abort := func(err error) (map[string]*vaultEntry, *cleanup, error) {
+		c.paths = restoredByUs
+		if joining {
+			// Leave the backups to the processes we joined
+			c.backups = map[string]string{}
+		}
+		restored := map[string]bool{}
+		for _, p := range restoredByUs {
+			restored[p] = true
+		}
+		for p, backup := range c.backups {
+			if !restored[p] {
+				os.Remove(backup)
+			}
+		}
+		c.run()
+		return nil, nil, err
+	}
+	for path, e := range restoredFiles {
+		if kept[app.pathOf(path)] {
+			continue
+		}
+		if joining && fileExists(app.pathOf(path)) {
+			context.Debug(fmt.Sprintf("reusing %s restored by another process", app.pathOf(path)))
+			continue
+		}
+		context.Debug(fmt.Sprintf("restoring %s", app.pathOf(path)))
+		if err := os.MkdirAll(filepath.Dir(app.pathOf(path)), 0700); err != nil {
+			return abort(err)
+		}
+		restoredByUs = append(restoredByUs, app.pathOf(path))
+		if err := e.restore(app.pathOf(path)); err != nil {
+			return abort(err)
 		}
 	}
 
-	return func() { app.cleanup(restoredFilePathes...) }, nil
+	return entries, c, nil
 }
 
-// RunOrPanic runs the app with the provided configuration. On any error it panics
-func (app *Job) RunOrPanic(command string, args ...string) error {
-	cleanup, err := app.Decrypt()
+// Verify compares the hashes of the files in the vault with the ones of the files in the working directory.
+// It returns an error when any of the files is missing or differs from the vault
+func (app *Job) Verify() error {
+	context := app.context
+	encryptedVault := app.encryptedVault()
+
+	svcs, err := context.keyServices()
 	if err != nil {
 		return err
 	}
+	entries, err := decryptVault(encryptedVault, svcs)
+	if err != nil {
+		return err
+	}
+	entries = fileEntries(entries)
+
+	paths := []string{}
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	failures := []string{}
+	for _, path := range paths {
+		expected, err := entries[path].checksum()
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+		if !fileExists(app.pathOf(path)) {
+			context.info.Printf("missing %s\n", path)
+			failures = append(failures, path)
+			continue
+		}
+		actual, err := fileChecksum(app.pathOf(path))
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			context.info.Printf("differs %s: sha256 %s in the vault, %s on the disk\n", path, expected, actual)
+			failures = append(failures, path)
+			continue
+		}
+		context.info.Printf("ok %s: sha256 %s\n", path, actual)
+	}
+
+	if len(failures) > 0 {
+		return withExitCode(ExitVerifyFailure, fmt.Errorf("%d of %d file(s) in %s are missing or differ: %s", len(failures), len(paths), relPath(encryptedVault), strings.Join(failures, ", ")))
+	}
+	return nil
+}
+
+// Migrate re-encrypts the vault into the layout and removes the vault in the other layout
+func (app *Job) Migrate(ctx context.Context, layout string) error {
+	unlock, err := app.lockVault(ctx, "migrating")
+	if err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	defer unlock()
+	if err := app.inUse(); err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
 
-	defer cleanup()
+	from := app.encryptedVault()
+	if !vaultExists(from) {
+		return withExitCode(ExitDecryptFailure, &FileNotFoundError{Path: from})
+	}
+	if layoutOf(from) == layout {
+		app.context.info.Printf("%s is already stored in the %s layout\n", relPath(from), layout)
+		return nil
+	}
+	to := filepath.Join(app.root, app.encryptedVaultFor(app.context.Env))
+	if layout == PerFileLayout {
+		to = filepath.Join(app.root, app.perFileVaultFor(app.context.Env))
+	}
+	if vaultExists(to) {
+		return withExitCode(ExitEncryptFailure, fmt.Errorf("both %s and %s exist. remove either of them", relPath(from), relPath(to)))
+	}
+
+	svcs, err := app.context.keyServices()
+	if err != nil {
+		return withExitCode(ExitConfigError, err)
+	}
+	entries, err := decryptVault(from, svcs)
+	if err != nil {
+		return withExitCode(ExitDecryptFailure, err)
+	}
+	a := &assets{context: app.context, files: entries}
+	if err := a.writeToFile(to); err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	if err := removeVault(from); err != nil {
+		return withExitCode(ExitEncryptFailure, fmt.Errorf("migrated into %s but failed to remove %s: %v", relPath(to), relPath(from), err))
+	}
+	app.context.info.Printf("migrated %d entries from %s into %s\n", len(entries), relPath(from), relPath(to))
+	return nil
+}
+
+// ImportEnv adds the environment variables defined in the dotenv file to the vault, replacing the ones with the same names
+func (app *Job) ImportEnv(ctx context.Context, dotenvFile string) error {
+	unlock, err := app.lockVault(ctx, "importing environment variables")
+	if err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	defer unlock()
+	if err := app.inUse(); err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	return withExitCode(ExitEncryptFailure, app.importEnv(dotenvFile))
+}
+
+func (app *Job) importEnv(dotenvFile string) error {
+	encryptedVault := app.encryptedVault()
 
-	app.context.Debug(fmt.Sprintf("running %s %s", command, strings.Join(args, " ")))
-	if err := runInForeground(command, args...); err != nil {
-		return fmt.Errorf("run: %v", err)
+	vars, err := readDotenv(dotenvFile)
+	if err != nil {
+		return err
+	}
+
+	assets, err := readAssetsFromFile(encryptedVault, app.context)
+	if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		if e, ok := assets.files[k]; ok && !e.isEnv() {
+			return fmt.Errorf("%s in %s conflicts with the file of the same name in %s", k, dotenvFile, relPath(encryptedVault))
+		}
+		app.context.Debug(fmt.Sprintf("adding environment variable %s to the vault", k))
+		assets.files[k] = newEnvEntry(v)
+	}
+	if err := assets.writeToFile(encryptedVault); err != nil {
+		return err
 	}
+	app.context.info.Printf("imported %d environment variable(s) from %s into %s\n", len(vars), dotenvFile, relPath(encryptedVault))
 	return nil
 }
 
-func (j *Job) cleanup(restoredFiles ...string) {
-	context := j.context
-	for _, path := range restoredFiles {
-		context.Debug(fmt.Sprintf("removing %s", path))
-		err := os.Remove(path)
+// RunOrPanic runs the app with the provided configuration. On any error it panics
+func (app *Job) RunOrPanic(ctx context.Context, command string, args ...string) error {
+	return runWithVaults(ctx, app.context, []*Job{app}, command, args...)
+}
+
+// session is the state of a vault while running a command with the files restored from it
+type session struct {
+	job          *Job
+	entries      map[string]*vaultEntry
+	cleanup      *cleanup
+	writeBackErr error
+	// runErr is the failure of the wrapped command, which makes the changes made by the command discarded instead of written back
+	runErr error
+}
+
+// runWithVaults runs the command with temporarily restoring files from the vaults of all the jobs.
+// Vaults are decrypted in the order of the jobs and cleaned up in the reverse order
+func runWithVaults(ctx context.Context, context *Context, jobs []*Job, command string, args ...string) error {
+	// Keep signals from killing us while decrypting, so that we never leave restored files behind
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	privateDir := context.PrivateDir
+	for _, j := range jobs {
+		privateDir = privateDir || j.privateDir
+	}
+
+	if len(jobs) > 1 {
+		if err := checkCollisions(jobs, privateDir); err != nil {
+			return withExitCode(ExitDecryptFailure, err)
+		}
+	}
+
+	if privateDir {
+		dir, err := createPrivateDir()
+		if err != nil {
+			return withExitCode(ExitDecryptFailure, err)
+		}
+		// The private directory is shared among the vaults, and removed by the first one after all the others are cleaned up
+		for i, j := range jobs {
+			j.dir = dir
+			j.sharesDir = i > 0
+		}
+		context.Debug(fmt.Sprintf("restoring files into %s", dir))
+	}
+
+	sessions := []*session{}
+	cleanupAll := func() {
+		for i := len(sessions) - 1; i >= 0; i-- {
+			sessions[i].cleanup.run()
+		}
+	}
+	defer cleanupAll()
+
+	var dirOwner *cleanup
+	for _, j := range jobs {
+		s, err := j.start(ctx, command, dirOwner)
 		if err != nil {
-			context.Warn(fmt.Sprintf("failed to remove %s: BEWARE THAT NO CLEARTEXT FILE IS REMAINING!", path))
+			if privateDir && len(sessions) == 0 {
+				removeFiles(context, j.dir)
+			}
+			return withExitCode(ExitDecryptFailure, err)
+		}
+		if privateDir && dirOwner == nil {
+			dirOwner = s.cleanup
+		}
+		sessions = append(sessions, s)
+	}
+
+	select {
+	case sig := <-signals:
+		code := ExitFailure
+		if s, ok := sig.(syscall.Signal); ok {
+			code = exitSignalOffset + int(s)
+		}
+		return withExitCode(code, fmt.Errorf("interrupted by %v before running %s", sig, command))
+	case <-ctx.Done():
+		return withExitCode(ExitFailure, fmt.Errorf("canceled before running %s: %w", command, ctx.Err()))
+	default:
+	}
+
+	dir, err := filepath.Abs(jobs[0].pathOf("."))
+	if err != nil {
+		return err
+	}
+	env := []string{fmt.Sprintf("%s=%s", dirEnv, dir)}
+	for _, s := range sessions {
+		for _, e := range s.job.exports {
+			env = append(env, fmt.Sprintf("%s=%s", e.name, expandDir(e.value, dir)))
+		}
+		env = append(env, environ(s.entries)...)
+	}
+	expandedArgs := []string{}
+	for _, a := range args {
+		expandedArgs = append(expandedArgs, expandDir(a, dir))
+	}
+
+	context.Debug(fmt.Sprintf("running %s %s", command, strings.Join(expandedArgs, " ")))
+	runErr := runInForeground(ctx, env, command, expandedArgs...)
+
+	for _, s := range sessions {
+		s.runErr = runErr
+	}
+	cleanupAll()
+
+	var writeBackErr error
+	for _, s := range sessions {
+		if s.writeBackErr == nil {
+			continue
 		}
+		if runErr != nil || writeBackErr != nil {
+			context.err.Println(s.writeBackErr.Error())
+			continue
+		}
+		writeBackErr = s.writeBackErr
+	}
+	if runErr != nil {
+		return runErr
 	}
+	return writeBackErr
 }
 
-func (j *assets) cleanup(restoredFiles ...string) {
-	context := j.context
-	for _, path := range restoredFiles {
-		context.Debug(fmt.Sprintf("removing %s", path))
-		err := os.Remove(path)
+// start restores files from the vault for running the command, and arranges them to be written back and cleaned up afterwards.
+// dirOwner is the cleanup removing the private directory shared with other vaults, if any
+func (app *Job) start(ctx context.Context, command string, dirOwner *cleanup) (*session, error) {
+	entries, cleanup, snap, err := app.join(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	if dirOwner == nil {
+		dirOwner = cleanup
+	}
+
+	s := &session{job: app, entries: entries, cleanup: cleanup}
+	cleanup.before = func() (bool, error) {
+		// Cleaning up is never canceled, so that no cleartext file is left behind
+		unlock, err := app.lockVault(context.Background(), fmt.Sprintf("cleaning up after %s", command))
+		if err != nil {
+			return false, err
+		}
+		cleanup.after = unlock
+		last, err := app.leave()
 		if err != nil {
-			context.Warn(fmt.Sprintf("failed to remove %s: BEWARE THAT NO CLEARTEXT FILE IS REMAINING!", path))
+			return false, err
+		}
+		if !last {
+			app.context.Debug(fmt.Sprintf("leaving restored files of %s to the other processes using them", app.vaultName))
+			return false, nil
+		}
+		if app.context.NoWriteBack {
+			return true, nil
+		}
+		// A command failed or interrupted halfway may leave partial output, which must not overwrite the files in the vault
+		if s.runErr != nil && !app.context.WriteBackOnFailure {
+			app.discardChanges(snap, command)
+			return true, nil
+		}
+		s.writeBackErr = app.writeBackChanges(snap, dirOwner)
+		return true, nil
+	}
+	return s, nil
+}
+
+// join restores files from the vault, or joins other sopsed processes using the files already restored from the vault.
+// The files are shared among processes only when they are restored into the working directory
+func (app *Job) join(ctx context.Context, command string) (map[string]*vaultEntry, *cleanup, *snapshot, error) {
+	unlock, err := app.lockVault(ctx, fmt.Sprintf("restoring files for %s", command))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer unlock()
+
+	var users *vaultUsers
+	if app.dir == "" {
+		if users, err = app.readUsers(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	joining := users != nil && len(users.Pids) > 0
+	if joining && users.Env != app.context.Env {
+		return nil, nil, nil, fmt.Errorf("vault %s is in use for env %q by `sopsed run` with pid(s) %v. retry after they exit", app.vaultName, users.Env, users.Pids)
+	}
+	if users != nil {
+		users.Env = app.context.Env
+	}
+
+	entries, c, err := app.decrypt(true, users)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	abort := func(err error) (map[string]*vaultEntry, *cleanup, *snapshot, error) {
+		if joining {
+			// Leave the files to the processes we joined
+			c.paths = []string{}
+		}
+		c.run()
+		return nil, nil, nil, err
+	}
+
+	snap, err := app.takeSnapshot(entries)
+	if err != nil {
+		return abort(err)
+	}
+	if users != nil {
+		if joining {
+			// Files created by the processes we joined are subject to write-back too
+			snap.untracked = users.untrackedSet()
+		} else {
+			users.Untracked = untrackedList(snap.untracked)
+		}
+		users.add(os.Getpid())
+		if err := app.writeUsers(users); err != nil {
+			return abort(err)
+		}
+	}
+	return entries, c, snap, nil
+}
+
+// leave unregisters this process from the users of the restored files, and returns true if it was the last user.
+// It must be called while the vault is locked
+func (app *Job) leave() (bool, error) {
+	if app.dir != "" {
+		return true, nil
+	}
+	users, err := app.readUsers()
+	if err != nil {
+		return false, err
+	}
+	users.remove(os.Getpid())
+	if err := app.writeUsers(users); err != nil {
+		return false, err
+	}
+	return len(users.Pids) == 0, nil
+}
+
+// discardChanges reports the changes made by the failed command, which are left out of the vault
+func (app *Job) discardChanges(snap *snapshot, command string) {
+	changes, err := app.detectChanges(snap)
+	if err != nil {
+		app.context.warn.Printf("failed to detect changes made to %s: %v\n", app.vaultName, err)
+		return
+	}
+	if changes.empty() {
+		return
+	}
+	app.context.warn.Printf("discarding changes to %s as %s failed. pass --write-back-on-failure to write them back anyway:\n%s\n", relPath(app.encryptedVault()), command, changes)
+	if app.dir == "" && len(changes.created) > 0 {
+		app.context.warn.Printf("keeping %s created by %s. encrypt them with `sopsed encrypt %s`, or remove them\n", strings.Join(relPaths(app.pathsOf(changes.created...)), ", "), command, app.vaultName)
+	}
+}
+
+// writeBackChanges re-encrypts the files changed by the wrapped command into the vault and arranges newly created files to be removed.
+// On failure, changed files are kept on the disk so that they aren't lost
+func (app *Job) writeBackChanges(snap *snapshot, cleanup *cleanup) error {
+	changes, err := app.detectChanges(snap)
+	if err != nil {
+		return withExitCode(ExitEncryptFailure, fmt.Errorf("failed to detect changes made to %s: %w", app.vaultName, err))
+	}
+	if changes.empty() {
+		return nil
+	}
+	app.context.info.Printf("writing back changes to %s:\n%s\n", relPath(app.encryptedVault()), changes)
+	if err := app.writeBack(snap, changes); err != nil {
+		kept := app.pathsOf(changes.written()...)
+		if app.dir != "" {
+			kept = []string{app.dir}
 		}
+		cleanup.keep(kept...)
+		return withExitCode(ExitEncryptFailure, fmt.Errorf("failed to write back changes to %s. keeping %s: %w", relPath(app.encryptedVault()), strings.Join(relPaths(kept), ", "), err))
 	}
+	cleanup.rehash(app.pathsOf(changes.modified...)...)
+	if app.dir == "" {
+		cleanup.add(app.pathsOf(changes.created...)...)
+	} else {
+		cleanup.record(app.pathsOf(changes.created...)...)
+	}
+	return nil
 }
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// journalFile lists the cleartext files restored by sopsed processes along with their hashes, pids and backups if any,
+// so that the files left behind by a process killed before cleaning up are detected and recovered by later invocations
+const journalFile = stateDir + "/journal"
+
+// journalEntry is a line of journalFile
+type journalEntry struct {
+	Pid int `json:"pid"`
+	// Start is the start time of the process, which tells it from another process reusing the pid
+	Start string `json:"start,omitempty"`
+	Vault string `json:"vault"`
+	Path  string `json:"path"`
+	// Checksum is the sha256 hash of the file when restored. Empty for a private directory
+	Checksum string `json:"sha256,omitempty"`
+	// Backup is the backup of the cleartext file existed at Path before restoring, which is put back on cleanup
+	Backup string `json:"backup,omitempty"`
+	Time   string `json:"time"`
+}
+
+// updateJournal rewrites journalFile with the entries returned by f. The journal is locked while being updated
+func updateJournal(f func([]journalEntry) []journalEntry) error {
+	path := statePath(journalFile)
+	if err := makeStateDir(path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", journalFile, err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	entries, err := parseJournal(file)
+	if err != nil {
+		return err
+	}
+	entries = f(entries)
+
+	lines := []string{}
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(b)+"\n")
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt([]byte(strings.Join(lines, "")), 0)
+	return err
+}
+
+func readJournal() ([]journalEntry, error) {
+	file, err := os.Open(statePath(journalFile))
+	if os.IsNotExist(err) {
+		return []journalEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseJournal(file)
+}
+
+func parseJournal(file *os.File) ([]journalEntry, error) {
+	entries := []journalEntry{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", journalFile, n, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func newJournalEntry(vault string, path string, checksum string, backup string) journalEntry {
+	return journalEntry{
+		Pid:      os.Getpid(),
+		Start:    processStartTime(os.Getpid()),
+		Vault:    vault,
+		Path:     absPath(path),
+		Checksum: checksum,
+		Backup:   absPath(backup),
+		Time:     time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// running returns true if the process recorded the entry is still running
+func (e journalEntry) running() bool {
+	return processRunning(e.Pid, e.Start)
+}
+
+// leftover is a cleartext file left behind by a sopsed process no longer running
+type leftover struct {
+	journalEntry
+	// changed is true when the file changed since it was restored, which is never removed automatically
+	changed bool
+	// inUse is true when a running sopsed process is using the file restored by the same vault
+	inUse bool
+}
+
+func (l leftover) String() string {
+	state := "unchanged"
+	if l.changed {
+		state = "CHANGED since restored"
+	}
+	return fmt.Sprintf("  %s (vault %s, pid %d at %s, %s)", relPath(l.Path), l.Vault, l.Pid, l.Time, state)
+}
+
+// findLeftovers returns the cleartext files left behind by sopsed processes no longer running
+func findLeftovers() ([]leftover, error) {
+	entries, err := readJournal()
+	if err != nil {
+		return nil, err
+	}
+	return leftoversIn(entries)
+}
+
+func leftoversIn(entries []journalEntry) ([]leftover, error) {
+	inUse := map[string]bool{}
+	for _, e := range entries {
+		if e.running() {
+			inUse[e.Path] = true
+		}
+	}
+	leftovers := []leftover{}
+	for _, e := range entries {
+		if e.running() {
+			continue
+		}
+		l := leftover{journalEntry: e, inUse: inUse[e.Path]}
+		if e.Checksum != "" && fileExists(e.Path) && !isPrivateDir(e.Path) {
+			sum, err := fileChecksum(e.Path)
+			if err != nil {
+				return nil, err
+			}
+			l.changed = sum != e.Checksum
+		}
+		leftovers = append(leftovers, l)
+	}
+	// Handle files before the private directories containing them
+	sort.SliceStable(leftovers, func(i, j int) bool {
+		return len(leftovers[i].Path) > len(leftovers[j].Path)
+	})
+	return leftovers, nil
+}
+
+// forgetLeftovers removes the entries of the files recorded by sopsed processes no longer running from the journal,
+// so that neither `sopsed recover` nor later runs remove or put back the files
+func forgetLeftovers(c *Context, paths ...string) error {
+	forgotten := map[string]bool{}
+	for _, p := range paths {
+		forgotten[absPath(p)] = true
+	}
+	return updateJournal(func(entries []journalEntry) []journalEntry {
+		ret := []journalEntry{}
+		for _, e := range entries {
+			if !forgotten[e.Path] || e.running() {
+				ret = append(ret, e)
+				continue
+			}
+			if e.Backup != "" && fileExists(e.Backup) {
+				c.warn.Printf("the file at %s before the interrupted process %d restored it is left at %s\n", relPath(e.Path), e.Pid, relPath(e.Backup))
+			}
+		}
+		return ret
+	})
+}
+
+// warnLeftovers loudly reports cleartext files left behind by sopsed processes no longer running
+func warnLeftovers(c *Context) {
+	leftovers, err := findLeftovers()
+	if err != nil {
+		c.warn.Printf("failed to read %s: %v\n", journalFile, err)
+		return
+	}
+	found := []string{}
+	for _, l := range leftovers {
+		if !l.inUse && (fileExists(l.Path) || (l.Backup != "" && fileExists(l.Backup))) {
+			found = append(found, l.String())
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	c.warn.Printf("CLEARTEXT FILES ARE LEFT BEHIND BY INTERRUPTED SOPSED PROCESSES:\n%s\nrun `sopsed recover` to clean them up\n", strings.Join(found, "\n"))
+}
+
+// recoverLeftovers removes cleartext files left behind by sopsed processes no longer running, and puts back the backups made by them.
+// Files changed since they were restored are left as-is and returned, along with the ones failed to be recovered
+func recoverLeftovers(c *Context) ([]leftover, error) {
+	remaining := []leftover{}
+	err := updateJournal(func(entries []journalEntry) []journalEntry {
+		leftovers, err := leftoversIn(entries)
+		if err != nil {
+			c.warn.Printf("failed to find files left behind by interrupted processes: %v\n", err)
+			return entries
+		}
+		kept := map[journalEntry]bool{}
+		for _, l := range leftovers {
+			switch {
+			case l.inUse:
+				// The running process restored the same file, which is removed by it
+				c.Debug(fmt.Sprintf("leaving %s left behind by the interrupted process %d to the running processes", relPath(l.Path), l.Pid))
+			case l.changed:
+				remaining = append(remaining, l)
+				kept[l.journalEntry] = true
+			case l.Backup != "":
+				done, err := putBack(c, l.Path, l.Backup)
+				if err != nil {
+					c.warn.Printf("failed to put back %s from %s: %v\n", relPath(l.Path), relPath(l.Backup), err)
+					remaining = append(remaining, l)
+					kept[l.journalEntry] = true
+				} else if done {
+					c.info.Printf("put back %s backed up by the interrupted process %d\n", relPath(l.Path), l.Pid)
+				}
+			case fileExists(l.Path):
+				if isPrivateDir(l.Path) && !emptyDir(l.Path) {
+					// Contains files not recorded in the journal, or changed since restored
+					remaining = append(remaining, l)
+					kept[l.journalEntry] = true
+					continue
+				}
+				if failed := removeFiles(c, l.Path); failed[l.Path] {
+					remaining = append(remaining, l)
+					kept[l.journalEntry] = true
+					continue
+				}
+				c.info.Printf("removed %s left behind by the interrupted process %d\n", relPath(l.Path), l.Pid)
+			}
+		}
+		ret := []journalEntry{}
+		for _, e := range entries {
+			if e.running() || kept[e] {
+				ret = append(ret, e)
+			}
+		}
+		return ret
+	})
+	return remaining, err
+}
+
+// emptyDir returns true if dir contains nothing but directories
+func emptyDir(dir string) bool {
+	empty := true
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			empty = false
+		}
+		return nil
+	})
+	return empty
+}
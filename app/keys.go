@@ -0,0 +1,196 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"go.mozilla.org/sops"
+	"go.mozilla.org/sops/gcpkms"
+	"go.mozilla.org/sops/keys"
+	"go.mozilla.org/sops/keyservice"
+	"go.mozilla.org/sops/kms"
+	"go.mozilla.org/sops/pgp"
+	sopsjson "go.mozilla.org/sops/stores/json"
+)
+
+// VaultKeys is the master keys of a vault, per sops document the vault consists of
+type VaultKeys struct {
+	Vault string
+	// Path is the path to the vault
+	Path      string
+	Documents []DocumentKeys
+}
+
+// DocumentKeys is the master keys of a sops document per key group, along with their creation dates
+type DocumentKeys struct {
+	Path            string
+	KeyGroups       [][]string
+	ShamirThreshold int
+}
+
+// String returns the master keys per key group, one key per line
+func (d DocumentKeys) String() string {
+	var b bytes.Buffer
+	for i, group := range d.KeyGroups {
+		fmt.Fprintf(&b, "  group %d:\n", i+1)
+		for _, k := range group {
+			fmt.Fprintf(&b, "    %s\n", k)
+		}
+	}
+	if d.ShamirThreshold > 0 && len(d.KeyGroups) > 1 {
+		fmt.Fprintf(&b, "  shamir threshold: %d\n", d.ShamirThreshold)
+	}
+	return b.String()
+}
+
+// String returns the master keys of the vault as printed by `sopsed keys ls`.
+// Documents of a vault stored per file usually share the same master keys, which are printed once
+func (v VaultKeys) String() string {
+	if len(v.Documents) == 0 {
+		return fmt.Sprintf("%s:\n  (no entries)\n", relPath(v.Path))
+	}
+	same := true
+	for _, d := range v.Documents {
+		same = same && d.String() == v.Documents[0].String()
+	}
+	if same {
+		return fmt.Sprintf("%s:\n%s", relPath(v.Path), v.Documents[0])
+	}
+	var b bytes.Buffer
+	for _, d := range v.Documents {
+		fmt.Fprintf(&b, "%s:\n%s", relPath(d.Path), d)
+	}
+	return b.String()
+}
+
+// ListKeys returns the master keys of the vault per key group
+func (app *Job) ListKeys() (*VaultKeys, error) {
+	path := app.encryptedVault()
+	if !vaultExists(path) {
+		return nil, withExitCode(ExitDecryptFailure, &FileNotFoundError{Path: path})
+	}
+	docs, err := documentsOf(path)
+	if err != nil {
+		return nil, withExitCode(ExitDecryptFailure, err)
+	}
+	keys := &VaultKeys{Vault: app.vaultName, Path: path, Documents: []DocumentKeys{}}
+	for _, doc := range docs {
+		metadata, err := readMetadata(doc)
+		if err != nil {
+			return nil, withExitCode(ExitDecryptFailure, err)
+		}
+		keys.Documents = append(keys.Documents, documentKeys(doc, metadata))
+	}
+	return keys, nil
+}
+
+// UpdateKeys adds and removes the master keys of the vault in Context.Recipients.
+// The data key is re-wrapped with the resulting master keys, leaving the encrypted values as-is
+func (app *Job) UpdateKeys(ctx context.Context) error {
+	if app.context.Recipients.empty() {
+		return withExitCode(ExitConfigError, fmt.Errorf("specify master keys to add or remove"))
+	}
+	unlock, err := app.lockVault(ctx, "updating master keys")
+	if err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	defer unlock()
+
+	path := app.encryptedVault()
+	if !vaultExists(path) {
+		return withExitCode(ExitDecryptFailure, &FileNotFoundError{Path: path})
+	}
+	docs, err := documentsOf(path)
+	if err != nil {
+		return withExitCode(ExitDecryptFailure, err)
+	}
+	svcs, err := app.context.keyServices()
+	if err != nil {
+		return withExitCode(ExitConfigError, err)
+	}
+	for _, doc := range docs {
+		if err := updateKeysOfDocument(doc, app.context.Recipients, svcs); err != nil {
+			return withExitCode(ExitEncryptFailure, fmt.Errorf("failed to update master keys of %s: %w", relPath(doc), err))
+		}
+	}
+	app.context.info.Printf("updated master keys of %s\n", relPath(path))
+	return nil
+}
+
+func readMetadata(path string) (sops.Metadata, error) {
+	encrypted, err := readVaultFile(path)
+	if err != nil {
+		return sops.Metadata{}, err
+	}
+	metadata, err := sopsjson.Store{}.UnmarshalMetadata(encrypted)
+	if err != nil {
+		return sops.Metadata{}, &CorruptedVaultError{Path: path, Err: fmt.Errorf("failed to read the metadata: %v", err)}
+	}
+	return metadata, nil
+}
+
+// updateKeysOfDocument re-wraps the data key of the sops document at path with the master keys changed by r, and replaces the document atomically
+func updateKeysOfDocument(path string, r Recipients, svcs []keyservice.KeyServiceClient) error {
+	encrypted, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	store := sopsjson.Store{}
+	metadata, err := store.UnmarshalMetadata(encrypted)
+	if err != nil {
+		return &CorruptedVaultError{Path: path, Err: fmt.Errorf("failed to read the metadata: %v", err)}
+	}
+	dataKey, err := metadata.GetDataKeyWithKeyServices(svcs)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the data key: %w", dataKeyAccessError(masterKeysOf(metadata), err))
+	}
+	branch, err := store.Unmarshal(encrypted)
+	if err != nil {
+		return &CorruptedVaultError{Path: path, Err: err}
+	}
+	groups, err := r.apply(metadata.KeyGroups)
+	if err != nil {
+		return err
+	}
+	metadata.KeyGroups = groups
+	if err := dataKeyError(metadata, metadata.UpdateMasterKeysWithKeyServices(dataKey, svcs)); err != nil {
+		return err
+	}
+	out, err := store.MarshalWithMetadata(branch, metadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, out, 0644)
+}
+
+// documentKeys describes the master keys in the metadata of the sops document at path
+func documentKeys(path string, metadata sops.Metadata) DocumentKeys {
+	d := DocumentKeys{Path: path, KeyGroups: [][]string{}, ShamirThreshold: metadata.ShamirThreshold}
+	for _, group := range metadata.KeyGroups {
+		keys := []string{}
+		for _, k := range group {
+			keys = append(keys, describeKey(k))
+		}
+		d.KeyGroups = append(d.KeyGroups, keys)
+	}
+	return d
+}
+
+func describeKey(k keys.MasterKey) string {
+	switch key := k.(type) {
+	case *pgp.MasterKey:
+		return fmt.Sprintf("pgp      %s  created %s", key.Fingerprint, key.CreationDate.UTC().Format(time.RFC3339))
+	case *kms.MasterKey:
+		desc := fmt.Sprintf("kms      %s  created %s", key.Arn, key.CreationDate.UTC().Format(time.RFC3339))
+		if key.Role != "" {
+			desc += fmt.Sprintf("  role %s", key.Role)
+		}
+		return desc
+	case *gcpkms.MasterKey:
+		return fmt.Sprintf("gcp_kms  %s  created %s", key.ResourceID, key.CreationDate.UTC().Format(time.RFC3339))
+	}
+	return k.ToString()
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mozilla.org/sops/keyservice"
+	"google.golang.org/grpc"
+)
+
+// DefaultKeyServiceEndpoint is the endpoint `sopsed keyservice serve` listens on by default, the same as `sops keyservice`
+const DefaultKeyServiceEndpoint = "tcp://127.0.0.1:5000"
+
+// keyServices returns the clients of the key services used for every operation on data keys.
+// The remote key services in Context.KeyServices are tried in order before the local one, unless the local one is disabled
+func (c *Context) keyServices() ([]keyservice.KeyServiceClient, error) {
+	if c.keyServiceClients != nil {
+		return c.keyServiceClients, nil
+	}
+	svcs := []keyservice.KeyServiceClient{}
+	for _, endpoint := range c.KeyServices {
+		svc, err := dialKeyService(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		svcs = append(svcs, svc)
+	}
+	if c.LocalKeyService {
+		svcs = append(svcs, keyservice.NewLocalClient())
+	}
+	if len(svcs) == 0 {
+		return nil, fmt.Errorf("no key service is available: specify --keyservice, or stop disabling the local key service")
+	}
+	c.keyServiceClients = svcs
+	return svcs, nil
+}
+
+// parseKeyServiceEndpoint splits the endpoint like `tcp://127.0.0.1:5000` or `unix:///run/sops.sock` into the network and the address.
+// An endpoint without the scheme is a TCP address
+func parseKeyServiceEndpoint(endpoint string) (string, string, error) {
+	if !strings.Contains(endpoint, "://") {
+		return "tcp", endpoint, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid key service endpoint %q: %v", endpoint, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		return "tcp", u.Host, nil
+	case "unix":
+		return "unix", u.Host + u.Path, nil
+	}
+	return "", "", fmt.Errorf("invalid key service endpoint %q: the scheme must be either tcp or unix", endpoint)
+}
+
+// dialKeyService returns a client of the remote key service. The connection is established lazily on the first call
+func dialKeyService(endpoint string) (keyservice.KeyServiceClient, error) {
+	network, address, err := parseKeyServiceEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, addr, timeout)
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to key service %s: %v", endpoint, err)
+	}
+	return keyservice.NewKeyServiceClient(conn), nil
+}
+
+// ServeKeyService runs a key service on the endpoint, or DefaultKeyServiceEndpoint when empty, until ctx is canceled.
+// It encrypts and decrypts data keys with the master keys available to this process
+func (a *App) ServeKeyService(ctx context.Context, endpoint string) error {
+	if endpoint == "" {
+		endpoint = DefaultKeyServiceEndpoint
+	}
+	network, address, err := parseKeyServiceEndpoint(endpoint)
+	if err != nil {
+		return withExitCode(ExitConfigError, err)
+	}
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", endpoint, err)
+	}
+	server := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(server, keyservice.Server{})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.info.Printf("stopping the key service on %s: %v\n", endpoint, ctx.Err())
+			server.GracefulStop()
+		case <-done:
+		}
+	}()
+
+	a.info.Printf("serving the key service on %s\n", endpoint)
+	// Serve closes the listener, which removes the socket file of a unix endpoint, when the server stops
+	if err := server.Serve(lis); err != nil {
+		return fmt.Errorf("key service on %s failed: %v", endpoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.mozilla.org/sops/keyservice"
+)
+
+// perFileVaultDir is the directory containing vaults stored per file, relative to the directory files in the vaults are relative to
+const perFileVaultDir = ".sopsed"
+
+// vaultIndexFile is the cleartext index of a vault stored per file
+const vaultIndexFile = "index.json"
+
+const vaultIndexVersion = 1
+
+// Layouts a vault can be stored in
+const (
+	// SingleLayout stores all the entries of a vault in one sops-encrypted JSON document like `.sops.vault.kubectl`
+	SingleLayout = "single"
+	// PerFileLayout stores each entry of a vault in its own sops-encrypted file under `.sopsed/<vault>/`, listed in a cleartext index
+	PerFileLayout = "per-file"
+)
+
+// vaultIndex lists the entries of a vault stored per file. It is never encrypted so that `git diff` tells which entries changed
+type vaultIndex struct {
+	Version int                   `json:"version"`
+	Entries map[string]indexEntry `json:"entries"`
+}
+
+// indexEntry is the file an entry is encrypted into, relative to the directory of the vault
+type indexEntry struct {
+	Kind string `json:"kind,omitempty"`
+	File string `json:"file"`
+}
+
+// perFileVaultFor returns the path to the directory of the vault for the environment stored per file, like `.sopsed/kubectl.prod`
+func (c *VaultConfig) perFileVaultFor(env string) string {
+	return filepath.Join(perFileVaultDir, strings.TrimPrefix(c.encryptedVaultFor(env), encryptedVaultPrefix))
+}
+
+// checkLayout returns an error if the vault can't be stored in the layout
+func checkLayout(name string, layout string) error {
+	switch layout {
+	case "", SingleLayout:
+		return nil
+	case PerFileLayout:
+		if name == filepath.Base(stateDir) {
+			return fmt.Errorf("vault %s can't be stored per file: %s is reserved for the states of sopsed processes", name, stateDir)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown layout %q: it must be either %s or %s", layout, SingleLayout, PerFileLayout)
+}
+
+// isPerFileVault returns true if path is a vault stored per file like `.sopsed/kubectl.prod`, whether it exists or not.
+// A vault stored in a single file is named like `.sops.vault.kubectl.prod` even when located in a .sopsed directory,
+// while the names of vaults stored per file never start with `.` as vault names are checked by checkVaultName
+func isPerFileVault(path string) bool {
+	return filepath.Base(filepath.Dir(path)) == perFileVaultDir && !strings.HasPrefix(filepath.Base(path), encryptedVaultPrefix)
+}
+
+// vaultExists returns true if the vault at path is encrypted in either of the layouts
+func vaultExists(path string) bool {
+	if isPerFileVault(path) {
+		return fileExists(filepath.Join(path, vaultIndexFile))
+	}
+	return fileExists(path)
+}
+
+// layoutOf returns the layout of the vault at path
+func layoutOf(path string) string {
+	if isPerFileVault(path) {
+		return PerFileLayout
+	}
+	return SingleLayout
+}
+
+func readVaultIndex(dir string) (*vaultIndex, error) {
+	path := filepath.Join(dir, vaultIndexFile)
+	b, err := readVaultFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &vaultIndex{}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, &CorruptedVaultError{Path: path, Err: err}
+	}
+	if index.Version != vaultIndexVersion {
+		return nil, fmt.Errorf("unsupported version %d of %s: upgrade sopsed", index.Version, relPath(path))
+	}
+	if index.Entries == nil {
+		index.Entries = map[string]indexEntry{}
+	}
+	return index, nil
+}
+
+// entryFile returns the path to the file the entry is encrypted into, relative to the directory of the vault
+func entryFile(key string, e *vaultEntry) (string, error) {
+	if e.isEnv() {
+		return path.Join("env", key+".json"), nil
+	}
+	p := path.Clean(filepath.ToSlash(key))
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%s can't be stored per file: it is outside of the directory of the vault", key)
+	}
+	return path.Join("files", p+".json"), nil
+}
+
+// decryptPerFileVault decrypts the entries listed in the index of the vault stored per file in dir
+func decryptPerFileVault(dir string, svcs []keyservice.KeyServiceClient) (map[string]*vaultEntry, error) {
+	index, err := readVaultIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*vaultEntry{}
+	for key, ie := range index.Entries {
+		path := filepath.Join(dir, filepath.FromSlash(ie.File))
+		encrypted, err := readVaultFile(path)
+		if err != nil {
+			return nil, err
+		}
+		jsonBytes, err := decryptJSON(path, encrypted, svcs)
+		if err != nil {
+			return nil, err
+		}
+		e := &vaultEntry{}
+		if err := json.Unmarshal(jsonBytes, e); err != nil {
+			return nil, &CorruptedVaultError{Path: path, Err: err}
+		}
+		entries[key] = e
+	}
+	return entries, nil
+}
+
+// writePerFileVault encrypts the entries into the vault stored per file in dir.
+// Only entries differing from the ones already in the vault are re-encrypted, so that unchanged files stay byte-for-byte identical in git
+func writePerFileVault(dir string, files map[string]*vaultEntry, svcs []keyservice.KeyServiceClient) error {
+	existing := map[string]*vaultEntry{}
+	old := &vaultIndex{Entries: map[string]indexEntry{}}
+	if vaultExists(dir) {
+		var err error
+		if old, err = readVaultIndex(dir); err != nil {
+			return err
+		}
+		if existing, err = decryptPerFileVault(dir, svcs); err != nil {
+			return err
+		}
+	}
+
+	index := &vaultIndex{Version: vaultIndexVersion, Entries: map[string]indexEntry{}}
+	for key, e := range files {
+		file, err := entryFile(key, e)
+		if err != nil {
+			return err
+		}
+		index.Entries[key] = indexEntry{Kind: e.Kind, File: file}
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		var previous []byte
+		if prev, ok := existing[key]; ok && old.Entries[key].File == file {
+			if *prev == *e {
+				continue
+			}
+			if previous, err = ioutil.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		out, err := encryptBranch(e.treeBranch(), dir, previous, svcs)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomically(path, out, 0644); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(filepath.Join(dir, vaultIndexFile), append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	// Files of removed entries are removed only after the index stops referring to them
+	for key, ie := range old.Entries {
+		if ne, ok := index.Entries[key]; ok && ne.File == ie.File {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(ie.File))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for d := filepath.Dir(path); d != dir && strings.HasPrefix(d, dir) && emptyDir(d); d = filepath.Dir(d) {
+			os.Remove(d)
+		}
+	}
+	return nil
+}
+
+// perFileVaultChecksum returns the checksum of the index and the files of the vault stored per file in dir
+func perFileVaultChecksum(dir string) ([sha256.Size]byte, error) {
+	index, err := readVaultIndex(dir)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	files := []string{vaultIndexFile}
+	for _, ie := range index.Entries {
+		files = append(files, ie.File)
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		b, err := readVaultFile(path)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		sum := sha256.Sum256(b)
+		fmt.Fprintf(h, "%s %x\n", f, sum)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// removeVault removes the vault at path in either of the layouts
+func removeVault(path string) error {
+	if isPerFileVault(path) {
+		return os.RemoveAll(path)
+	}
+	return os.Remove(path)
+}
+
+// writeFileAtomically writes data to a temporary file next to path and renames it to path,
+// so that readers never see a partially written file
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
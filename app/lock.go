@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultLockTimeout is how long sopsed waits for another sopsed process to release the lock on a vault
+const DefaultLockTimeout = 30 * time.Second
+
+// lockDir is the directory containing the lock files of vaults
+const lockDir = stateDir + "/locks"
+
+// lockPollInterval is the interval to retry acquiring a lock held by another process
+const lockPollInterval = 100 * time.Millisecond
+
+// lockVault acquires the exclusive advisory lock on the vault, waiting up to Context.LockTimeout for other sopsed processes to release it.
+// purpose is shown to other processes waiting for the lock. The lock is released by calling the returned func, or by the process exiting.
+// Cancelling ctx stops waiting for the lock
+func (app *Job) lockVault(ctx context.Context, purpose string) (func(), error) {
+	context := app.context
+	path := statePath(filepath.Join(lockDir, app.vaultName+".lock"))
+	if err := makeStateDir(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := context.LockTimeout
+	if timeout == 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		holder := lockHolder(path)
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out after %v waiting for the lock on vault %s held by %s. retry after it finishes, or increase --lock-timeout", timeout, app.vaultName, holder)
+		}
+		if !waiting {
+			context.info.Printf("waiting for the lock on vault %s held by %s\n", app.vaultName, holder)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("gave up waiting for the lock on vault %s held by %s: %w", app.vaultName, holder, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	// Tell processes waiting for the lock who is holding it
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("pid %d (%s)", os.Getpid(), purpose)), 0)
+	}
+	context.Debug(fmt.Sprintf("locked vault %s for %s", app.vaultName, purpose))
+
+	return func() {
+		f.Truncate(0)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		context.Debug(fmt.Sprintf("unlocked vault %s", app.vaultName))
+	}, nil
+}
+
+// lockHolder returns the description of the process holding the lock file at path
+func lockHolder(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(b))) == 0 {
+		return "another sopsed process"
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"regexp"
+	"strings"
+)
+
+// argsMatcher decides whether a vault is used for an invocation by looking at the args given to the wrapped command
+type argsMatcher struct {
+	subcommands []string
+	patterns    []*regexp.Regexp
+}
+
+func (m argsMatcher) empty() bool {
+	return len(m.subcommands) == 0 && len(m.patterns) == 0
+}
+
+// positionalArgs returns the args other than flags and the values of valueFlags given as separate args, like `kube-system` of `-n kube-system`.
+// Every arg after `--` is positional
+func positionalArgs(args []string, valueFlags []string) []string {
+	positionals := []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return append(positionals, args[i+1:]...)
+		}
+		if !strings.HasPrefix(a, "-") {
+			positionals = append(positionals, a)
+			continue
+		}
+		if containsString(valueFlags, a) {
+			i++
+		}
+	}
+	return positionals
+}
+
+// matchesSubcommand returns true if the positional args begin with any of the subcommands.
+// A subcommand may consist of multiple words like "render credentials".
+// valueFlags are the flags taking their values as separate args, whose values aren't positional
+func (m argsMatcher) matchesSubcommand(args []string, valueFlags []string) bool {
+	positionals := positionalArgs(args, valueFlags)
+	for _, s := range m.subcommands {
+		words := strings.Fields(s)
+		if len(words) == 0 || len(words) > len(positionals) {
+			continue
+		}
+		matched := true
+		for i, w := range words {
+			if positionals[i] != w {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPattern returns true if any of the patterns matches the args joined with spaces
+func (m argsMatcher) matchesPattern(args []string) bool {
+	joined := strings.Join(args, " ")
+	for _, p := range m.patterns {
+		if p.MatchString(joined) {
+			return true
+		}
+	}
+	return false
+}
+
+// includes returns true if args satisfy every kind of rule configured in this matcher
+func (m argsMatcher) includes(args []string, valueFlags []string) bool {
+	if len(m.subcommands) > 0 && !m.matchesSubcommand(args, valueFlags) {
+		return false
+	}
+	if len(m.patterns) > 0 && !m.matchesPattern(args) {
+		return false
+	}
+	return true
+}
+
+// excludes returns true if args satisfy any of the rules configured in this matcher
+func (m argsMatcher) excludes(args []string, valueFlags []string) bool {
+	return m.matchesSubcommand(args, valueFlags) || m.matchesPattern(args)
+}
+
+func compilePatterns(patterns ...string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
+	for _, p := range patterns {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func mustCompilePatterns(patterns ...string) []*regexp.Regexp {
+	compiled, err := compilePatterns(patterns...)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirEnv is the environment variable pointing the wrapped command at the directory files are restored into.
+// It is also expanded in args to the wrapped command and in the values of exported environment variables
+const dirEnv = "SOPSED_DIR"
+
+// privateDirPrefix is the prefix of the names of private directories, which tells them apart from files on cleanup
+const privateDirPrefix = "sopsed-"
+
+// createPrivateDir creates a directory only accessible by the current user in a memory-backed filesystem,
+// so that restored files never hit the disk nor the working tree
+func createPrivateDir() (string, error) {
+	bases := []string{}
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		bases = append(bases, d)
+	}
+	bases = append(bases, "/dev/shm")
+	for _, base := range bases {
+		if info, err := os.Stat(base); err != nil || !info.IsDir() {
+			continue
+		}
+		dir, err := ioutil.TempDir(base, privateDirPrefix)
+		if err != nil {
+			return "", fmt.Errorf("failed to create a private directory in %s: %v", base, err)
+		}
+		if err := os.Chmod(dir, 0700); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		return dir, nil
+	}
+	return "", fmt.Errorf("neither $XDG_RUNTIME_DIR nor /dev/shm is available to create a private directory in")
+}
+
+// isPrivateDir returns true if path is a private directory created by createPrivateDir
+func isPrivateDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir() && strings.HasPrefix(filepath.Base(path), privateDirPrefix)
+}
+
+// expandDir replaces $SOPSED_DIR and ${SOPSED_DIR} in s with dir, leaving any other variable as-is
+func expandDir(s string, dir string) string {
+	s = strings.Replace(s, "${"+dirEnv+"}", dir, -1)
+	return strings.Replace(s, "$"+dirEnv, dir, -1)
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// projectRoot returns the root directory of the git repository containing the working directory, or the working directory when it isn't in any.
+// Vaults are searched up to the project root, and the states of sopsed processes are kept in the .sopsed directory in it.
+// It is computed on every call rather than cached, so that a program embedding sopsed can change the working directory between calls
+func projectRoot() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	for dir := cwd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		if filepath.Dir(dir) == dir {
+			return cwd
+		}
+	}
+}
+
+// stateDir is the directory containing the states shared by all the sopsed processes run in the project, relative to the project root
+const stateDir = ".sopsed/state"
+
+// stateIgnoreFile keeps the states like the backups of cleartext files out of git, even when the .sopsed directory is committed for per-file vaults
+const stateIgnoreFile = stateDir + "/.gitignore"
+
+// makeStateDir creates the directory containing the file in the state directory, along with stateIgnoreFile
+func makeStateDir(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	ignore := statePath(stateIgnoreFile)
+	if fileExists(ignore) {
+		return nil
+	}
+	return ioutil.WriteFile(ignore, []byte("*\n"), 0644)
+}
+
+// statePath returns the path to the file in the .sopsed directory shared by all the sopsed processes run in the project
+func statePath(path string) string {
+	return filepath.Join(projectRoot(), path)
+}
+
+// findUp returns the path to the file found first in the working directory or any of its parents up to the project root
+func findUp(name string) (string, bool) {
+	dir, found := findDirContaining(name)
+	if !found {
+		return "", false
+	}
+	return filepath.Join(dir, name), true
+}
+
+// findDirContaining returns the nearest directory containing any of the files, from the working directory up to the project root
+func findDirContaining(names ...string) (string, bool) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", false
+	}
+	root := projectRoot()
+	for dir := cwd; ; dir = filepath.Dir(dir) {
+		for _, name := range names {
+			if fileExists(filepath.Join(dir, name)) {
+				return dir, true
+			}
+		}
+		if dir == root || filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
+
+// vaultRoot returns the absolute path to the directory containing the vault for the environment, which files in the vault are relative to.
+// It is the location of the vault if configured, or the nearest directory containing the vault from the working directory up to the project root.
+// It defaults to the working directory for a vault not encrypted yet
+func (c *VaultConfig) vaultRoot(env string) (string, error) {
+	if c.location != "" {
+		dir := c.location
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(projectRoot(), dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("location %s of vault %s is not a directory", relPath(dir), c.vaultName)
+		}
+		return dir, nil
+	}
+	if dir, found := findDirContaining(c.encryptedVaultFor(env), filepath.Join(c.perFileVaultFor(env), vaultIndexFile)); found {
+		return dir, nil
+	}
+	return os.Getwd()
+}
+
+// absPath returns the absolute path, or the path as-is when it is empty or can't be made absolute
+func absPath(path string) string {
+	if path == "" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+func relPaths(paths []string) []string {
+	rel := []string{}
+	for _, p := range paths {
+		rel = append(rel, relPath(p))
+	}
+	return rel
+}
+
+// relPath returns the path relative to the working directory for messages, or the path as-is when it can't be
+func relPath(path string) string {
+	cwd, err := os.Getwd()
+	if err != nil || !filepath.IsAbs(path) {
+		return path
+	}
+	rel, err := filepath.Rel(cwd, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.mozilla.org/sops"
+	"go.mozilla.org/sops/aes"
+	"go.mozilla.org/sops/gcpkms"
+	"go.mozilla.org/sops/keyservice"
+	"go.mozilla.org/sops/kms"
+	"go.mozilla.org/sops/pgp"
+)
+
+// Recipients is the master keys explicitly added to or removed from vaults.
+// Vaults are encrypted with the master keys of the creation rules in .sops.yaml when none is given
+type Recipients struct {
+	AddPGP       []string
+	RemovePGP    []string
+	AddKMS       []string
+	RemoveKMS    []string
+	AddGCPKMS    []string
+	RemoveGCPKMS []string
+}
+
+func (r Recipients) empty() bool {
+	return len(r.AddPGP)+len(r.RemovePGP)+len(r.AddKMS)+len(r.RemoveKMS)+len(r.AddGCPKMS)+len(r.RemoveGCPKMS) == 0
+}
+
+func (r Recipients) added() sops.KeyGroup {
+	var keys sops.KeyGroup
+	for _, arn := range r.AddKMS {
+		for _, k := range kms.MasterKeysFromArnString(arn, nil) {
+			keys = append(keys, k)
+		}
+	}
+	for _, id := range r.AddGCPKMS {
+		keys = append(keys, gcpkms.NewMasterKeyFromResourceID(id))
+	}
+	for _, fp := range r.AddPGP {
+		keys = append(keys, pgp.NewMasterKeyFromFingerprint(fp))
+	}
+	return keys
+}
+
+func (r Recipients) removed() []string {
+	removed := []string{}
+	for _, arn := range r.RemoveKMS {
+		// The role of the `arn+role` form isn't a part of keys.MasterKey.ToString
+		removed = append(removed, strings.SplitN(arn, "+", 2)[0])
+	}
+	removed = append(removed, r.RemoveGCPKMS...)
+	return append(removed, r.RemovePGP...)
+}
+
+// apply returns the key groups with the removed keys removed from every group and the added keys appended to the first group
+func (r Recipients) apply(groups []sops.KeyGroup) ([]sops.KeyGroup, error) {
+	removed := r.removed()
+	found := map[string]bool{}
+	existing := map[string]bool{}
+	result := []sops.KeyGroup{}
+	for _, g := range groups {
+		kept := sops.KeyGroup{}
+		for _, k := range g {
+			if containsString(removed, k.ToString()) {
+				found[k.ToString()] = true
+				continue
+			}
+			existing[k.ToString()] = true
+			kept = append(kept, k)
+		}
+		result = append(result, kept)
+	}
+	for _, id := range removed {
+		if !found[id] {
+			return nil, fmt.Errorf("%s is not a master key of the vault", id)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, sops.KeyGroup{})
+	}
+	for _, k := range r.added() {
+		if existing[k.ToString()] {
+			return nil, fmt.Errorf("%s is already a master key of the vault", k.ToString())
+		}
+		existing[k.ToString()] = true
+		result[0] = append(result[0], k)
+	}
+	for _, g := range result {
+		if len(g) == 0 {
+			return nil, fmt.Errorf("no master key would be left in a key group of the vault")
+		}
+	}
+	return result, nil
+}
+
+// Rotate re-encrypts the vault with a new data key. The data key is encrypted with the master keys of the creation rule in .sops.yaml,
+// or the master keys of the vault changed by Context.Recipients
+func (app *Job) Rotate(ctx context.Context) error {
+	unlock, err := app.lockVault(ctx, "rotating the data key")
+	if err != nil {
+		return withExitCode(ExitEncryptFailure, err)
+	}
+	defer unlock()
+
+	path := app.encryptedVault()
+	if !vaultExists(path) {
+		return withExitCode(ExitDecryptFailure, &FileNotFoundError{Path: path})
+	}
+	docs, err := documentsOf(path)
+	if err != nil {
+		return withExitCode(ExitDecryptFailure, err)
+	}
+	svcs, err := app.context.keyServices()
+	if err != nil {
+		return withExitCode(ExitConfigError, err)
+	}
+	for _, doc := range docs {
+		if err := rotateDocument(doc, path, app.context.Recipients, svcs); err != nil {
+			return withExitCode(ExitEncryptFailure, fmt.Errorf("failed to rotate the data key of %s: %w", relPath(doc), err))
+		}
+	}
+	app.context.info.Printf("rotated the data key of %s\n", relPath(path))
+	return nil
+}
+
+// documentsOf returns the paths to the sops documents the vault at path consists of
+func documentsOf(path string) ([]string, error) {
+	if !isPerFileVault(path) {
+		return []string{path}, nil
+	}
+	index, err := readVaultIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	docs := []string{}
+	for _, ie := range index.Entries {
+		docs = append(docs, filepath.Join(path, filepath.FromSlash(ie.File)))
+	}
+	sort.Strings(docs)
+	return docs, nil
+}
+
+// rotateDocument re-encrypts the sops document at path with a new data key, replacing the document atomically.
+// vault is the path the creation rule is looked up for
+func rotateDocument(path string, vault string, r Recipients, svcs []keyservice.KeyServiceClient) error {
+	encrypted, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc, err := decryptDocument(path, encrypted, svcs)
+	if err != nil {
+		return err
+	}
+	tree := doc.tree
+	if r.empty() {
+		groups, threshold, err := keyGroupsFor(vault)
+		if err != nil {
+			return err
+		}
+		tree.Metadata.KeyGroups = groups
+		tree.Metadata.ShamirThreshold = threshold
+	} else {
+		groups, err := r.apply(tree.Metadata.KeyGroups)
+		if err != nil {
+			return err
+		}
+		tree.Metadata.KeyGroups = groups
+	}
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(svcs)
+	if err := dataKeyError(tree.Metadata, errs); err != nil {
+		return err
+	}
+	out, _, err := encryptTree(tree, dataKey, aes.NewCipher())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, out, 0644)
+}
@@ -3,11 +3,14 @@ package app
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 func runAndCaptureStdout(ctx *Context, command string, args ...string) (string, error) {
@@ -108,14 +111,47 @@ func runInBackground(ctx *Context, command string, args ...string) error {
 	return nil
 }
 
-func runInForeground(command string, args ...string) error {
+// runInForeground runs the command attached to the terminal, with the env in the form of "KEY=value" added to the environment.
+// SIGINT, SIGTERM and SIGHUP sent to sopsed are relayed to the command instead of killing sopsed,
+// so that sopsed can clean up after the command exits. Cancelling ctx sends SIGTERM to the command for the same reason
+func runInForeground(ctx context.Context, env []string, command string, args ...string) error {
 	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), env...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
 
-	if err := cmd.Run(); nil != err {
-		return fmt.Errorf("failed running %s: %s", cmd.Path, err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); nil != err {
+		return commandStartError(command, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		canceled := ctx.Done()
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-canceled:
+				cmd.Process.Signal(syscall.SIGTERM)
+				canceled = nil
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := cmd.Wait(); nil != err {
+		err = commandExitError(command, err)
+		if ctx.Err() != nil {
+			return withExitCode(exitCodeOf(err), fmt.Errorf("stopped %s: %w", command, ctx.Err()))
+		}
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,303 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mozilla.org/sops"
+	"go.mozilla.org/sops/aes"
+	"go.mozilla.org/sops/gcpkms"
+	"go.mozilla.org/sops/keyservice"
+	"go.mozilla.org/sops/kms"
+	"go.mozilla.org/sops/pgp"
+	sopsjson "go.mozilla.org/sops/stores/json"
+	"gopkg.in/yaml.v2"
+)
+
+// sopsConfigFile is the name of the sops config file containing creation rules
+const sopsConfigFile = ".sops.yaml"
+
+// sopsVersion is recorded in the metadata of vaults encrypted by sopsed.
+// It is the version of the vendored go.mozilla.org/sops
+const sopsVersion = "3.0.2"
+
+// sopsConfig is the subset of the .sops.yaml schema used by sopsed.
+// We can't use go.mozilla.org/sops/config for this because it isn't part of the vendored library
+type sopsConfig struct {
+	CreationRules []creationRule `yaml:"creation_rules"`
+}
+
+type creationRule struct {
+	FilenameRegex   string         `yaml:"filename_regex"`
+	KMS             string         `yaml:"kms"`
+	PGP             string         `yaml:"pgp"`
+	GCPKMS          string         `yaml:"gcp_kms"`
+	KeyGroups       []sopsKeyGroup `yaml:"key_groups"`
+	ShamirThreshold int            `yaml:"shamir_threshold"`
+}
+
+type sopsKeyGroup struct {
+	KMS    []sopsKMSKey    `yaml:"kms"`
+	GCPKMS []sopsGCPKMSKey `yaml:"gcp_kms"`
+	PGP    []string        `yaml:"pgp"`
+}
+
+type sopsKMSKey struct {
+	Arn     string             `yaml:"arn"`
+	Role    string             `yaml:"role"`
+	Context map[string]*string `yaml:"context"`
+}
+
+type sopsGCPKMSKey struct {
+	ResourceID string `yaml:"resource_id"`
+}
+
+// findSopsConfig looks for .sops.yaml in dir and its parents, like sops does
+func findSopsConfig(start string) (string, error) {
+	for dir := start; ; {
+		path := filepath.Join(dir, sopsConfigFile)
+		if fileExists(path) {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", &SopsConfigNotFoundError{Dir: start}
+		}
+		dir = parent
+	}
+}
+
+// keyGroupsFor returns the key groups and the shamir threshold of the first creation rule matching the path
+func keyGroupsFor(path string) ([]sops.KeyGroup, int, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	configPath, err := findSopsConfig(filepath.Dir(path))
+	if err != nil {
+		return nil, 0, err
+	}
+	// filename_regex is matched against the path relative to .sops.yaml, as sops does for files given relative to it
+	if rel, err := filepath.Rel(filepath.Dir(configPath), path); err == nil {
+		path = filepath.ToSlash(rel)
+	}
+	src, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %v", configPath, err)
+	}
+	var c sopsConfig
+	if err := yaml.Unmarshal(src, &c); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+
+	for _, r := range c.CreationRules {
+		if r.FilenameRegex != "" {
+			matched, err := regexp.MatchString(r.FilenameRegex, path)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid filename_regex in %s: %v", configPath, err)
+			}
+			if !matched {
+				continue
+			}
+		}
+		return r.keyGroups(), r.ShamirThreshold, nil
+	}
+	return nil, 0, &NoCreationRuleError{Config: configPath, Path: path}
+}
+
+func (r creationRule) keyGroups() []sops.KeyGroup {
+	if len(r.KeyGroups) > 0 {
+		groups := []sops.KeyGroup{}
+		for _, g := range r.KeyGroups {
+			var group sops.KeyGroup
+			for _, k := range g.KMS {
+				group = append(group, kms.NewMasterKey(k.Arn, k.Role, k.Context))
+			}
+			for _, k := range g.GCPKMS {
+				group = append(group, gcpkms.NewMasterKeyFromResourceID(k.ResourceID))
+			}
+			for _, fp := range g.PGP {
+				group = append(group, pgp.NewMasterKeyFromFingerprint(fp))
+			}
+			groups = append(groups, group)
+		}
+		return groups
+	}
+
+	var group sops.KeyGroup
+	for _, k := range kms.MasterKeysFromArnString(r.KMS, nil) {
+		group = append(group, k)
+	}
+	for _, k := range gcpkms.MasterKeysFromResourceIDString(r.GCPKMS) {
+		group = append(group, k)
+	}
+	for _, k := range pgp.MasterKeysFromFingerprintString(r.PGP) {
+		group = append(group, k)
+	}
+	return []sops.KeyGroup{group}
+}
+
+// encryptFiles encrypts the cleartext files in memory into a sops JSON document, using the creation rule matching path.
+// Unlike shelling out to `sops --encrypt`, this never writes cleartext to the disk.
+// previous is the document being replaced, if any, whose data key is reused by encryptBranch
+func encryptFiles(files map[string]*vaultEntry, path string, previous []byte, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	keys := []string{}
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	branch := sops.TreeBranch{}
+	for _, k := range keys {
+		branch = append(branch, sops.TreeItem{Key: k, Value: files[k].treeBranch()})
+	}
+	return encryptBranch(branch, path, previous, svcs)
+}
+
+// encryptBranch encrypts the tree into a sops JSON document, using the creation rule matching path.
+// When previous is not nil, the document is re-encrypted with the data key and the master keys of previous instead,
+// so that values unchanged since previous keep their ciphertext and `git diff` shows only the changed ones
+func encryptBranch(branch sops.TreeBranch, path string, previous []byte, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	if previous != nil {
+		return reencryptBranch(branch, path, previous, svcs)
+	}
+
+	groups, threshold, err := keyGroupsFor(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := sops.Tree{
+		Branch: branch,
+		Metadata: sops.Metadata{
+			KeyGroups:         groups,
+			ShamirThreshold:   threshold,
+			UnencryptedSuffix: sops.DefaultUnencryptedSuffix,
+			Version:           sopsVersion,
+		},
+	}
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(svcs)
+	if err := dataKeyError(tree.Metadata, errs); err != nil {
+		return nil, err
+	}
+
+	out, _, err := encryptTree(tree, dataKey, aes.NewCipher())
+	return out, err
+}
+
+// reencryptBranch encrypts the tree with the data key of the previous document.
+// Decrypting previous stashes the IV of every value in the cipher, which encrypts the same value at the same path into the same ciphertext.
+// previous is returned as-is when nothing changed, so that its last-modified time and MAC are kept as well
+func reencryptBranch(branch sops.TreeBranch, path string, previous []byte, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	doc, err := decryptDocument(path, previous, svcs)
+	if err != nil {
+		return nil, err
+	}
+	tree := sops.Tree{Branch: branch, Metadata: doc.tree.Metadata}
+	out, mac, err := encryptTree(tree, doc.dataKey, doc.cipher)
+	if err != nil {
+		return nil, err
+	}
+	if mac == doc.mac {
+		return previous, nil
+	}
+	return out, nil
+}
+
+// decryptedDocument is a sops JSON document decrypted in memory
+type decryptedDocument struct {
+	// tree is the decrypted values along with the metadata of the document
+	tree    sops.Tree
+	dataKey []byte
+	// cipher has stashed the IVs of the values
+	cipher aes.Cipher
+	mac    string
+}
+
+// decryptDocument decrypts the sops JSON document read from path and verifies its integrity.
+// Unlike decrypt.Data, the data key is decrypted via the key services
+func decryptDocument(path string, encrypted []byte, svcs []keyservice.KeyServiceClient) (*decryptedDocument, error) {
+	store := sopsjson.Store{}
+	metadata, err := store.UnmarshalMetadata(encrypted)
+	if err != nil {
+		return nil, &CorruptedVaultError{Path: path, Err: fmt.Errorf("failed to read the metadata: %v", err)}
+	}
+	dataKey, err := metadata.GetDataKeyWithKeyServices(svcs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the data key of %s: %w", relPath(path), dataKeyAccessError(masterKeysOf(metadata), err))
+	}
+	branch, err := store.Unmarshal(encrypted)
+	if err != nil {
+		return nil, &CorruptedVaultError{Path: path, Err: err}
+	}
+	tree := sops.Tree{Branch: branch, Metadata: metadata}
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(dataKey, cipher)
+	if err != nil {
+		return nil, &CorruptedVaultError{Path: path, Err: err}
+	}
+	originalMac, err := cipher.Decrypt(metadata.MessageAuthenticationCode, dataKey, metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, &CorruptedVaultError{Path: path, Err: fmt.Errorf("failed to decrypt the mac: %v", err)}
+	}
+	if originalMac != mac {
+		return nil, &MacMismatchError{Path: path}
+	}
+	return &decryptedDocument{tree: tree, dataKey: dataKey, cipher: cipher, mac: mac}, nil
+}
+
+// dataKeyError returns an error describing the failures to encrypt a data key with the master keys in the metadata, if any
+func dataKeyError(metadata sops.Metadata, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := []string{}
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Errorf("failed to encrypt the data key: %w", dataKeyAccessError(masterKeysOf(metadata), errors.New(strings.Join(msgs, ", "))))
+}
+
+// masterKeysOf returns the identifiers of the master keys in the metadata, like KMS ARNs and PGP fingerprints
+func masterKeysOf(metadata sops.Metadata) []string {
+	ids := []string{}
+	for _, group := range metadata.KeyGroups {
+		for _, k := range group {
+			ids = append(ids, k.ToString())
+		}
+	}
+	return ids
+}
+
+// encryptTree encrypts the values of the tree in place and marshals it along with the metadata.
+// It also returns the cleartext MAC of the values
+func encryptTree(tree sops.Tree, dataKey []byte, cipher aes.Cipher) ([]byte, string, error) {
+	mac, err := tree.Encrypt(dataKey, cipher)
+	if err != nil {
+		return nil, "", err
+	}
+	tree.Metadata.LastModified = time.Now().UTC()
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(mac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt the mac: %v", err)
+	}
+	out, err := sopsjson.Store{}.MarshalWithMetadata(tree.Branch, tree.Metadata)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, mac, nil
+}
+
+// decryptJSON decrypts the sops JSON document read from path into the cleartext JSON without the metadata
+func decryptJSON(path string, encrypted []byte, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	doc, err := decryptDocument(path, encrypted, svcs)
+	if err != nil {
+		return nil, err
+	}
+	return sopsjson.Store{}.Marshal(doc.tree.Branch)
+}
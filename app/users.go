@@ -0,0 +1,126 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// usersDir is the directory containing the states of vaults whose files are restored into the working directory
+const usersDir = stateDir + "/users"
+
+// vaultUsers is the state shared among sopsed processes concurrently using the files restored from a vault.
+// The files are restored by the first process and removed by the last one. It must be read and written only while the vault is locked
+type vaultUsers struct {
+	// Pids is the list of sopsed processes using the restored files
+	Pids []int `json:"pids"`
+	// Starts maps the pids to the start times of the processes, which tell them from other processes reusing the pids
+	Starts map[int]string `json:"starts,omitempty"`
+	// Env is the environment of the vault the files are restored from
+	Env string `json:"env,omitempty"`
+	// Untracked is the list of files matching the globs of the vault but not stored in it, before the first process restored files
+	Untracked []string `json:"untracked"`
+	// Kept is the list of files existed before the first process restored files, which are identical to the ones in the vault and never removed
+	Kept []string `json:"kept,omitempty"`
+	// Backups maps files existed before the first process restored files to their backups, which are put back by the last process
+	Backups map[string]string `json:"backups,omitempty"`
+}
+
+func (app *Job) usersFile() string {
+	return statePath(filepath.Join(usersDir, app.vaultName+".json"))
+}
+
+// readUsers reads the users of the vault, excluding processes no longer running
+func (app *Job) readUsers() (*vaultUsers, error) {
+	u := &vaultUsers{}
+	b, err := ioutil.ReadFile(app.usersFile())
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, u); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", app.usersFile(), err)
+	}
+	alive := []int{}
+	for _, pid := range u.Pids {
+		if processRunning(pid, u.Starts[pid]) {
+			alive = append(alive, pid)
+		} else {
+			delete(u.Starts, pid)
+		}
+	}
+	u.Pids = alive
+	return u, nil
+}
+
+func (app *Job) writeUsers(u *vaultUsers) error {
+	if len(u.Pids) == 0 {
+		if err := os.Remove(app.usersFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := makeStateDir(app.usersFile()); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(app.usersFile(), b, 0600)
+}
+
+func (u *vaultUsers) add(pid int) {
+	u.Pids = append(u.Pids, pid)
+	if u.Starts == nil {
+		u.Starts = map[int]string{}
+	}
+	u.Starts[pid] = processStartTime(pid)
+}
+
+func (u *vaultUsers) remove(pid int) {
+	remaining := []int{}
+	for _, p := range u.Pids {
+		if p != pid {
+			remaining = append(remaining, p)
+		}
+	}
+	u.Pids = remaining
+	delete(u.Starts, pid)
+}
+
+func (u *vaultUsers) untrackedSet() map[string]bool {
+	set := map[string]bool{}
+	for _, f := range u.Untracked {
+		set[f] = true
+	}
+	return set
+}
+
+func untrackedList(set map[string]bool) []string {
+	list := []string{}
+	for f := range set {
+		list = append(list, f)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// inUse returns an error if any other sopsed process is running with the files restored from the vault.
+// It must be called while the vault is locked
+func (app *Job) inUse() error {
+	u, err := app.readUsers()
+	if err != nil {
+		return err
+	}
+	u.remove(os.Getpid())
+	if len(u.Pids) > 0 {
+		return fmt.Errorf("vault %s is in use by `sopsed run` with pid(s) %v. retry after they exit", app.vaultName, u.Pids)
+	}
+	return nil
+}
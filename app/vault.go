@@ -1,6 +1,13 @@
 package app
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
 
 type entry struct {
 	pathPattern string
@@ -10,14 +17,40 @@ type entry struct {
 type VaultConfig struct {
 	vaultName string
 	entries   []entry
-	commands  []string
+	// regexps match the paths of files stored in the vault, in addition to the globs in entries
+	regexps []*regexp.Regexp
+	// excludes are the globs of files never stored in the vault even when they match entries or regexps
+	excludes []string
+	commands []string
+	used     argsMatcher
+	notUsed  argsMatcher
+	// valueFlags are the flags of the commands taking their values as separate args
+	valueFlags []string
+	// location is the directory containing the vault, relative to the project root. Empty to search for the vault
+	location string
+	// privateDir restores files into a private directory instead of the working directory
+	privateDir bool
+	exports    []export
+	// layout is the layout a new vault is stored in. Empty for SingleLayout
+	layout string
+}
+
+// export is an environment variable set for the wrapped command, whose value may refer to $SOPSED_DIR
+type export struct {
+	name  string
+	value string
 }
 
 type VaultBuilder struct {
 	*VaultConfig
 }
 
+// NewVault returns the builder of the vault named name, which consists of alphanumerics, `-` and `_`.
+// It panics when the name is invalid
 func NewVault(name string) *VaultBuilder {
+	if err := checkVaultName(name); err != nil {
+		panic(err)
+	}
 	return &VaultBuilder{
 		&VaultConfig{
 			vaultName: name,
@@ -30,21 +63,118 @@ func (b *VaultBuilder) UsedForCommand(commands ...string) *VaultBuilder {
 	return b
 }
 
+// StoresFilesMatchingGlob stores files matching any of the globs in the vault.
+// `**` matches any number of directories, and a glob prefixed with `!` excludes files like ExcludesFilesMatchingGlob.
+// It panics when any of the globs fails to compile
 func (b *VaultBuilder) StoresFilesMatchingGlob(globs ...string) *VaultBuilder {
 	entries := []entry{}
 	for _, g := range globs {
+		if strings.HasPrefix(g, "!") {
+			b.ExcludesFilesMatchingGlob(g[1:])
+			continue
+		}
+		mustCompileGlobs(g)
 		entries = append(entries, entry{g})
 	}
 	b.entries = entries
 	return b
 }
 
+// LocatedIn places the vault in the directory, relative to the root of the git repository when it isn't absolute.
+// Files in the vault are restored relative to the directory regardless of the working directory
+func (b *VaultBuilder) LocatedIn(dir string) *VaultBuilder {
+	b.location = dir
+	return b
+}
+
+// StoresFilesMatchingRegexp stores files whose slash-separated paths relative to the directory containing the vault match any of the regexps in the vault.
+// It panics when any of the regexps fails to compile
+func (b *VaultBuilder) StoresFilesMatchingRegexp(patterns ...string) *VaultBuilder {
+	b.regexps = append(b.regexps, mustCompilePatterns(patterns...)...)
+	return b
+}
+
+// ExcludesFilesMatchingGlob never stores files matching any of the globs in the vault.
+// A glob without `/` is matched against the base names of files. It panics when any of the globs fails to compile
+func (b *VaultBuilder) ExcludesFilesMatchingGlob(globs ...string) *VaultBuilder {
+	mustCompileGlobs(globs...)
+	b.excludes = append(b.excludes, globs...)
+	return b
+}
+
+// UsedForSubcommand restricts the vault to invocations whose positional args begin with any of the subcommands.
+// Use a space-separated subcommand like "render credentials" to match nested subcommands.
+// Args not starting with `-` are positional, so flags taking values must be given like `--flag=value` or listed in TakesFlagsWithValues
+func (b *VaultBuilder) UsedForSubcommand(subcommands ...string) *VaultBuilder {
+	b.used.subcommands = subcommands
+	return b
+}
+
+// TakesFlagsWithValues lists the flags of the commands taking their values as separate args, like `-n` of `kubectl -n kube-system get`,
+// so that the values aren't mistaken for subcommands
+func (b *VaultBuilder) TakesFlagsWithValues(flags ...string) *VaultBuilder {
+	b.valueFlags = append(b.valueFlags, flags...)
+	return b
+}
+
+// UsedWhenArgsMatch restricts the vault to invocations whose space-joined args match any of the regular expressions.
+// It panics when any of the patterns fails to compile
+func (b *VaultBuilder) UsedWhenArgsMatch(patterns ...string) *VaultBuilder {
+	b.used.patterns = mustCompilePatterns(patterns...)
+	return b
+}
+
+// NotUsedForSubcommand excludes invocations whose positional args begin with any of the subcommands, which are told apart the same as UsedForSubcommand
+func (b *VaultBuilder) NotUsedForSubcommand(subcommands ...string) *VaultBuilder {
+	b.notUsed.subcommands = subcommands
+	return b
+}
+
+// NotUsedWhenArgsMatch excludes invocations whose space-joined args match any of the regular expressions.
+// It panics when any of the patterns fails to compile
+func (b *VaultBuilder) NotUsedWhenArgsMatch(patterns ...string) *VaultBuilder {
+	b.notUsed.patterns = mustCompilePatterns(patterns...)
+	return b
+}
+
+// RestoresIntoPrivateDir makes the vault restore files into a private directory in $XDG_RUNTIME_DIR or /dev/shm
+// rather than the working directory. The wrapped command finds the directory in $SOPSED_DIR
+func (b *VaultBuilder) RestoresIntoPrivateDir() *VaultBuilder {
+	b.privateDir = true
+	return b
+}
+
+// ExportsEnv sets the environment variable for the wrapped command. $SOPSED_DIR in the value is expanded to the directory files are restored into,
+// so that `ExportsEnv("KUBECONFIG", "$SOPSED_DIR/kubeconfig")` points kubectl at the restored kubeconfig
+func (b *VaultBuilder) ExportsEnv(name string, value string) *VaultBuilder {
+	b.exports = append(b.exports, export{name: name, value: value})
+	return b
+}
+
+// StoresEntriesPerFile stores each file of the vault in its own sops-encrypted file under `.sopsed/<vault>/`, listed in a cleartext index,
+// so that changing a file re-encrypts only that file. A vault already encrypted into `.sops.vault.<vault>` is kept as-is until migrated
+func (b *VaultBuilder) StoresEntriesPerFile() *VaultBuilder {
+	b.layout = PerFileLayout
+	return b
+}
+
 func (b *VaultBuilder) Build() *VaultConfig {
 	return b.VaultConfig
 }
 
-// MatchesCommand returns true if this config is for the vault of the given command
+// MatchesCommand returns true if this config is for the vault of the given command and args
 func (c *VaultConfig) MatchesCommand(command string, args ...string) bool {
+	if !c.handlesCommand(command) {
+		return false
+	}
+	if !c.used.empty() && !c.used.includes(args, c.valueFlags) {
+		return false
+	}
+	return !c.notUsed.excludes(args, c.valueFlags)
+}
+
+// handlesCommand returns true if the command is wrapped by this config regardless of args
+func (c *VaultConfig) handlesCommand(command string) bool {
 	for _, c := range c.commands {
 		if c == command {
 			return true
@@ -53,10 +183,98 @@ func (c *VaultConfig) MatchesCommand(command string, args ...string) bool {
 	return false
 }
 
-func (c *VaultConfig) unencryptedVault() string {
-	return fmt.Sprintf(".sops.vault.%s.insecure", c.vaultName)
+// filesMatchingGlobs returns the sorted list of files under dir matching any of the globs or regexps of the vault and none of the excludes, relative to dir.
+// Empty dir means the working directory
+func (c *VaultConfig) filesMatchingGlobs(dir string) ([]string, error) {
+	found := map[string]bool{}
+	for _, e := range c.entries {
+		var files []string
+		if strings.Contains(e.pathPattern, "**") {
+			r, err := compileGlob(e.pathPattern)
+			if err != nil {
+				return nil, err
+			}
+			if files, err = walkFiles(dir, globBase(e.pathPattern), r); err != nil {
+				return nil, err
+			}
+		} else {
+			matches, err := filepath.Glob(filepath.Join(dir, e.pathPattern))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range matches {
+				// Directories and symlinks matching the glob aren't stored, the same as the files found by walkFiles
+				if info, err := os.Lstat(f); err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				if dir != "" {
+					if f, err = filepath.Rel(dir, f); err != nil {
+						return nil, err
+					}
+				}
+				files = append(files, f)
+			}
+		}
+		for _, f := range files {
+			found[f] = true
+		}
+	}
+	for _, r := range c.regexps {
+		files, err := walkFiles(dir, ".", r)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			found[f] = true
+		}
+	}
+
+	excludes, err := compileGlobs(c.excludes...)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for f := range found {
+		skip := false
+		for i, x := range excludes {
+			skip = skip || excluded(filepath.ToSlash(f), x, !strings.Contains(c.excludes[i], "/"))
+		}
+		if !skip {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func compileGlobs(globs ...string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
+	for _, g := range globs {
+		r, err := compileGlob(g)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func mustCompileGlobs(globs ...string) []*regexp.Regexp {
+	compiled, err := compileGlobs(globs...)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
 }
 
 func (c *VaultConfig) encryptedVault() string {
-	return fmt.Sprintf(".sops.vault.%s", c.vaultName)
+	return fmt.Sprintf("%s%s", encryptedVaultPrefix, c.vaultName)
+}
+
+// encryptedVaultFor returns the path to the vault for the environment, like `.sops.vault.kubectl.prod`
+func (c *VaultConfig) encryptedVaultFor(env string) string {
+	if env == "" {
+		return c.encryptedVault()
+	}
+	return fmt.Sprintf("%s.%s", c.encryptedVault(), env)
 }
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFilesMatchingGlobsSkipsDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sopsed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "cert.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"cert.pem", filepath.Join("cert.d", "ca.pem")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("cleartext"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := NewVault("certs").StoresFilesMatchingGlob("cert*", "cert.d/*").filesMatchingGlobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join("cert.d", "ca.pem"), "cert.pem"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files: got %v, want %v", files, expected)
+	}
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// snapshot is the state of the files of a vault right before running the wrapped command
+type snapshot struct {
+	// entries is all the entries in the vault, including environment variables
+	entries map[string]*vaultEntry
+	// restored is the file entries restored from the vault
+	restored map[string]*vaultEntry
+	// untracked is the set of files matching the globs of the vault but not stored in it
+	untracked map[string]bool
+}
+
+// changes is the set of files of a vault changed by the wrapped command
+type changes struct {
+	modified []string
+	created  []string
+	deleted  []string
+}
+
+func (c changes) empty() bool {
+	return len(c.modified) == 0 && len(c.created) == 0 && len(c.deleted) == 0
+}
+
+// written returns the files to be read from the disk on write-back
+func (c changes) written() []string {
+	return append(append([]string{}, c.modified...), c.created...)
+}
+
+func (c changes) String() string {
+	lines := []string{}
+	for _, p := range c.modified {
+		lines = append(lines, fmt.Sprintf("  modified: %s", p))
+	}
+	for _, p := range c.created {
+		lines = append(lines, fmt.Sprintf("  created:  %s", p))
+	}
+	for _, p := range c.deleted {
+		lines = append(lines, fmt.Sprintf("  deleted:  %s", p))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (app *Job) takeSnapshot(entries map[string]*vaultEntry) (*snapshot, error) {
+	restored := fileEntries(entries)
+	files, err := app.filesMatchingGlobs(app.base())
+	if err != nil {
+		return nil, err
+	}
+	untracked := map[string]bool{}
+	for _, f := range files {
+		if _, ok := restored[f]; !ok {
+			untracked[f] = true
+		}
+	}
+	return &snapshot{entries: entries, restored: restored, untracked: untracked}, nil
+}
+
+// detectChanges compares the files on the disk with the snapshot
+func (app *Job) detectChanges(s *snapshot) (changes, error) {
+	var c changes
+
+	paths := []string{}
+	for p := range s.restored {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		e := s.restored[p]
+		info, err := os.Stat(app.pathOf(p))
+		if os.IsNotExist(err) {
+			c.deleted = append(c.deleted, p)
+			continue
+		}
+		if err != nil {
+			return c, err
+		}
+		expectedSum, err := e.checksum()
+		if err != nil {
+			return c, err
+		}
+		actualSum, err := fileChecksum(app.pathOf(p))
+		if err != nil {
+			return c, err
+		}
+		expectedMode, err := e.fileMode(p)
+		if err != nil {
+			return c, err
+		}
+		if actualSum != expectedSum || info.Mode().Perm() != expectedMode {
+			c.modified = append(c.modified, p)
+		}
+	}
+
+	files, err := app.filesMatchingGlobs(app.base())
+	if err != nil {
+		return c, err
+	}
+	for _, f := range files {
+		if _, ok := s.restored[f]; ok {
+			continue
+		}
+		if !s.untracked[f] {
+			c.created = append(c.created, f)
+		}
+	}
+	return c, nil
+}
+
+// writeBack re-encrypts the vault with the changes made by the wrapped command
+func (app *Job) writeBack(s *snapshot, c changes) error {
+	files := map[string]*vaultEntry{}
+	for p, e := range s.entries {
+		files[p] = e
+	}
+	for _, p := range c.deleted {
+		delete(files, p)
+	}
+	for _, p := range c.written() {
+		e, err := newVaultEntry(app.pathOf(p))
+		if err != nil {
+			return err
+		}
+		files[p] = e
+	}
+	a := &assets{context: app.context, files: files}
+	return a.writeToFile(app.encryptedVault())
+}
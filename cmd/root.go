@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mumoshu/sopsed/app"
 	"github.com/spf13/cobra"
@@ -13,25 +17,64 @@ var RootCmd = &cobra.Command{
 	Short: "sopsed is a general wrapper for mozilla/sops to transparently encrypt/decrypt files according to the command being run",
 	Long: `sopsed is a general wrapper for mozilla/sops to transparently encrypt/decrypt files according to the command being run.
 				  Complete documentation is available at https://github.com/mumoshu/sopsed`,
+	// Fail on unknown commands like `sopsed bogus` with the usage, rather than showing the help and exiting successfully
 	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+	// Parse flags of `run` given before the wrapped command, while leaving the args to the wrapped command as-is
+	TraverseChildren: true,
 }
 
 func Init(app *app.App) {
+	RootCmd.PersistentFlags().StringVar(&app.Env, "env", app.Env, "Environment to select vaults like .sops.vault.kubectl.prod for. Defaults to $SOPSED_ENV")
+	RootCmd.PersistentFlags().DurationVar(&app.LockTimeout, "lock-timeout", app.LockTimeout, "How long to wait for other sopsed processes to release the lock on a vault")
+	RootCmd.PersistentFlags().StringSliceVar(&app.KeyServices, "keyservice", app.KeyServices, "Endpoints of remote sops key services like tcp://10.0.0.1:5000 or unix:///run/sops.sock, used for every operation on data keys. Defaults to `keyservices` in .sopsed.yaml")
+	RootCmd.PersistentFlags().BoolVar(&app.LocalKeyService, "enable-local-keyservice", app.LocalKeyService, "Use the master keys available to this process after the remote key services")
+
 	runCmd := &cobra.Command{
 		Use:   "run wrapped-command [args...]",
 		Short: "Run wrapped-command with temporarily decrypting required files from the vault",
-		Args:  cobra.NoArgs,
+		Args:  cobra.ArbitraryArgs,
+		// Commands configured for any vault are run by the subcommands added below, so this runs only the ones unknown to all the vaults,
+		// which the app rejects with app.ExitNoVault
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			_, err := app.Run(context.Background(), args[0], args[1:]...)
+			return err
+		},
 	}
+	addRunFlags(runCmd, app)
 	RootCmd.AddCommand(runCmd)
 
+	var vaults []string
+	execCmd := &cobra.Command{
+		Use:   "exec --vault NAME [--vault NAME...] [--] command [args...]",
+		Short: "Run any command with temporarily decrypting the named vaults",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			app.Infof("running %s\n", args[0])
+			code, err := app.Exec(context.Background(), vaults, args[0], args[1:]...)
+			exit(app, code, err)
+		},
+	}
+	execCmd.Flags().StringArrayVar(&vaults, "vault", nil, "Name of the vault to be decrypted. Can be specified multiple times")
+	addRunFlags(execCmd, app)
+	// Leave flags after the command to the command, like `sopsed exec --vault certs openssl x509 -in cert.pem`
+	execCmd.Flags().SetInterspersed(false)
+	RootCmd.AddCommand(execCmd)
+
 	for _, cmd := range app.Commands() {
 		c := &cobra.Command{
 			Use:   fmt.Sprintf("%s [args]", cmd),
 			Short: fmt.Sprintf("Run %s with temporarily decrypting required files from the vault", cmd),
 			Args:  cobra.ArbitraryArgs,
 			Run: func(cmd *cobra.Command, args []string) {
-				fmt.Printf("running %s\n", cmd.Name())
-				app.Run(cmd.Name(), args...)
+				app.Infof("running %s\n", cmd.Name())
+				code, err := app.Run(context.Background(), cmd.Name(), args...)
+				exit(app, code, err)
 			},
 		}
 		c.DisableFlagParsing = true
@@ -44,10 +87,12 @@ func Init(app *app.App) {
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			v := args[0]
-			fmt.Printf("decryptiong %s\n", v)
-			app.Decrypt(v)
+			app.Infof("decrypting %s\n", v)
+			code, err := app.Decrypt(context.Background(), v)
+			exit(app, code, err)
 		},
 	}
+	decryptCmd.Flags().BoolVar(&app.Force, "force", false, "Back up cleartext files differing from the ones in the vault into .sopsed/state/backups and overwrite them, instead of failing")
 	RootCmd.AddCommand(decryptCmd)
 
 	encryptCmd := &cobra.Command{
@@ -56,17 +101,198 @@ func Init(app *app.App) {
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			v := args[0]
-			fmt.Printf("encrypting %s\n", v)
-			app.Encrypt(v)
+			app.Infof("encrypting %s\n", v)
+			code, err := app.Encrypt(context.Background(), v)
+			exit(app, code, err)
 		},
 	}
+	encryptCmd.Flags().BoolVar(&app.DryRun, "dry-run", false, "Print the files to be encrypted into the vault without encrypting them")
 	RootCmd.AddCommand(encryptCmd)
 
+	verifyCmd := &cobra.Command{
+		Use:   "verify [vault]",
+		Short: "Verify that cleartext files are byte-for-byte identical to the ones in a named vault",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			v := args[0]
+			app.Infof("verifying %s\n", v)
+			exitOnError(app, app.Verify(v))
+		},
+	}
+	RootCmd.AddCommand(verifyCmd)
+
+	var layout string
+	migrateCmd := &cobra.Command{
+		Use:   "migrate [vault]",
+		Short: "Convert a named vault between the single and per-file layouts",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(app, app.Migrate(context.Background(), args[0], layout))
+		},
+	}
+	migrateCmd.Flags().StringVar(&layout, "to", "per-file", "The layout to convert the vault into: either single or per-file")
+	RootCmd.AddCommand(migrateCmd)
+
+	var rotateAll bool
+	rotateCmd := &cobra.Command{
+		Use:   "rotate [vault...]",
+		Short: "Re-encrypt named vaults with new data keys, against the current creation rules in .sops.yaml or the added and removed master keys",
+		Args:  cobra.ArbitraryArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(app, app.Rotate(context.Background(), args, rotateAll))
+		},
+	}
+	rotateCmd.Flags().BoolVar(&rotateAll, "all", false, "Rotate all the vaults encrypted for the environment")
+	rotateCmd.Flags().StringSliceVar(&app.Recipients.AddPGP, "add-pgp", nil, "Add the PGP fingerprints to the master keys of the vaults, instead of using .sops.yaml")
+	rotateCmd.Flags().StringSliceVar(&app.Recipients.RemovePGP, "rm-pgp", nil, "Remove the PGP fingerprints from the master keys of the vaults, instead of using .sops.yaml")
+	rotateCmd.Flags().StringSliceVar(&app.Recipients.AddKMS, "add-kms", nil, "Add the KMS ARNs to the master keys of the vaults, instead of using .sops.yaml")
+	rotateCmd.Flags().StringSliceVar(&app.Recipients.RemoveKMS, "rm-kms", nil, "Remove the KMS ARNs from the master keys of the vaults, instead of using .sops.yaml")
+	rotateCmd.Flags().StringSliceVar(&app.Recipients.AddGCPKMS, "add-gcp-kms", nil, "Add the GCP KMS resource IDs to the master keys of the vaults, instead of using .sops.yaml")
+	rotateCmd.Flags().StringSliceVar(&app.Recipients.RemoveGCPKMS, "rm-gcp-kms", nil, "Remove the GCP KMS resource IDs from the master keys of the vaults, instead of using .sops.yaml")
+	RootCmd.AddCommand(rotateCmd)
+
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage the master keys vaults are encrypted to",
+	}
+	keysLsCmd := &cobra.Command{
+		Use:   "ls [vault...]",
+		Short: "List the master keys of the vaults per key group",
+		Args:  cobra.ArbitraryArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			keys, err := app.ListKeys(args)
+			exitOnError(app, err)
+			for _, k := range keys {
+				fmt.Print(k)
+			}
+		},
+	}
+	keysCmd.AddCommand(keysLsCmd)
+	keysAddCmd := &cobra.Command{
+		Use:   "add [vault]",
+		Short: "Add master keys to a named vault, without re-encrypting the files in it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(app, app.UpdateKeys(context.Background(), args[0]))
+		},
+	}
+	keysAddCmd.Flags().StringSliceVar(&app.Recipients.AddPGP, "pgp", nil, "The PGP fingerprints to add")
+	keysAddCmd.Flags().StringSliceVar(&app.Recipients.AddKMS, "kms", nil, "The KMS ARNs to add")
+	keysAddCmd.Flags().StringSliceVar(&app.Recipients.AddGCPKMS, "gcp-kms", nil, "The GCP KMS resource IDs to add")
+	keysCmd.AddCommand(keysAddCmd)
+	keysRmCmd := &cobra.Command{
+		Use:   "rm [vault]",
+		Short: "Remove master keys from a named vault, without re-encrypting the files in it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(app, app.UpdateKeys(context.Background(), args[0]))
+		},
+	}
+	keysRmCmd.Flags().StringSliceVar(&app.Recipients.RemovePGP, "pgp", nil, "The PGP fingerprints to remove")
+	keysRmCmd.Flags().StringSliceVar(&app.Recipients.RemoveKMS, "kms", nil, "The KMS ARNs to remove")
+	keysRmCmd.Flags().StringSliceVar(&app.Recipients.RemoveGCPKMS, "gcp-kms", nil, "The GCP KMS resource IDs to remove")
+	keysCmd.AddCommand(keysRmCmd)
+	RootCmd.AddCommand(keysCmd)
+
+	var listen string
+	keyserviceCmd := &cobra.Command{
+		Use:   "keyservice",
+		Short: "Run a sops key service",
+	}
+	keyserviceServeCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve data key operations for remote sopsed and sops processes with the master keys available to this process",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// The key service stops gracefully on signals, instead of being killed by them
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			exitOnError(app, app.ServeKeyService(ctx, listen))
+		},
+	}
+	keyserviceServeCmd.Flags().StringVar(&listen, "listen", "", "The endpoint to listen on, like unix:///run/sops.sock. Defaults to tcp://127.0.0.1:5000")
+	keyserviceCmd.AddCommand(keyserviceServeCmd)
+	RootCmd.AddCommand(keyserviceCmd)
+
+	recoverCmd := &cobra.Command{
+		Use:   "recover",
+		Short: "Remove cleartext files left behind by interrupted sopsed processes, except the ones changed since restored",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(app, app.Recover())
+		},
+	}
+	RootCmd.AddCommand(recoverCmd)
+
+	envsCmd := &cobra.Command{
+		Use:   "envs [vault...]",
+		Short: "List the environments the vaults are encrypted for",
+		Args:  cobra.ArbitraryArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			envs, err := app.ListEnvs(args)
+			exitOnError(app, err)
+			for _, e := range envs {
+				fmt.Println(e)
+			}
+		},
+	}
+	RootCmd.AddCommand(envsCmd)
+
+	importEnvCmd := &cobra.Command{
+		Use:   "import-env [vault] [dotenv-file]",
+		Short: "Import environment variables from a dotenv file into a named vault, to be exposed to wrapped commands",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			v := args[0]
+			app.Infof("importing %s into %s\n", args[1], v)
+			exitOnError(app, app.ImportEnv(context.Background(), v, args[1]))
+		},
+	}
+	RootCmd.AddCommand(importEnvCmd)
+
 }
 
+// Execute runs the command initialized by Init, and exits with the exit code for the error if any
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if code := execute(); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// execute runs the command initialized by Init and returns the exit code for the error, which cobra has already reported.
+// Invalid command-line args result in app.ExitUsageError
+func execute() int {
+	err := RootCmd.Execute()
+	if err == nil {
+		return 0
+	}
+	var e interface{ ExitCode() int }
+	if errors.As(err, &e) {
+		return e.ExitCode()
 	}
+	return app.ExitUsageError
+}
+
+// exit exits the process with the exit code returned by the app, after printing the error if any.
+// The app never exits the process by itself, so that it can be embedded into other programs
+func exit(a *app.App, code int, err error) {
+	if err != nil {
+		a.PrintError(err)
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// exitOnError exits the process with the exit code for the error returned by the app, if any
+func exitOnError(a *app.App, err error) {
+	exit(a, app.ExitCode(err), err)
+}
+
+// addRunFlags adds the flags controlling how the wrapped command is run with decrypted files
+func addRunFlags(c *cobra.Command, app *app.App) {
+	c.Flags().BoolVar(&app.NoWriteBack, "no-write-back", false, "Do not re-encrypt files modified or created by the wrapped command into the vault")
+	c.Flags().BoolVar(&app.WriteBackOnFailure, "write-back-on-failure", false, "Re-encrypt files modified or created by the wrapped command into the vault even when the command fails or is interrupted")
+	c.Flags().BoolVar(&app.PrivateDir, "private-dir", false, "Restore files into a private directory in $XDG_RUNTIME_DIR or /dev/shm pointed by $SOPSED_DIR, instead of the working directory")
+	c.Flags().BoolVar(&app.Force, "force", false, "Back up cleartext files differing from the ones in the vault and put them back after the wrapped command exits, instead of failing")
 }
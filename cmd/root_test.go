@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mumoshu/sopsed/app"
+)
+
+func TestExecuteExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sopsed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	Init(app.NewApp(app.NewContext(), app.NewVault("kubectl").StoresFilesMatchingGlob("kubeconfig").UsedForCommand("kubectl")))
+	RootCmd.SetOutput(ioutil.Discard)
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{args: []string{}, code: 0},
+		{args: []string{"bogus"}, code: app.ExitUsageError},
+		{args: []string{"--bogus"}, code: app.ExitUsageError},
+		{args: []string{"run"}, code: 0},
+		{args: []string{"run", "nosuch"}, code: app.ExitNoVault},
+		{args: []string{"exec"}, code: app.ExitUsageError},
+	}
+	for _, tt := range tests {
+		RootCmd.SetArgs(tt.args)
+		if code := execute(); code != tt.code {
+			t.Errorf("sopsed %v exited with %d, want %d", tt.args, code, tt.code)
+		}
+	}
+}
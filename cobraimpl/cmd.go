@@ -1,6 +1,8 @@
 package cobraimpl
 
 import (
+	"os"
+
 	"github.com/mumoshu/sopsed/app"
 	"github.com/mumoshu/sopsed/cmd"
 	"github.com/spf13/cobra"
@@ -8,11 +10,22 @@ import (
 
 func CreateCommand() *cobra.Command {
 	ctx := app.NewContext()
-	ap := app.NewApp(
-		ctx,
-		app.NewVault("kube-aws").UsedForCommand("kube-aws").StoresFilesMatchingGlob("credentials/*-key.pem", "credentials/tokens.csv", "credentials/kubelet-tls-bootstrap-token"),
+	vaults, err := app.LoadVaults(
+		app.ConfigFile,
+		app.NewVault("kube-aws").UsedForCommand("kube-aws").StoresFilesMatchingGlob("credentials/*-key.pem", "credentials/tokens.csv", "credentials/kubelet-tls-bootstrap-token").
+			NotUsedForSubcommand("version", "help").NotUsedWhenArgsMatch(`(^| )(-h|--help)( |$)`),
 		app.NewVault("kubectl").UsedForCommand("kubectl", "helm", "helm-secrets", "helmfile").StoresFilesMatchingGlob("kubeconfig"),
 	)
+	if err != nil {
+		ctx.PrintError(err)
+		os.Exit(app.ExitCode(err))
+	}
+	ctx.KeyServices, err = app.LoadKeyServices(app.ConfigFile)
+	if err != nil {
+		ctx.PrintError(err)
+		os.Exit(app.ExitCode(err))
+	}
+	ap := app.NewApp(ctx, vaults...)
 
 	cmd.Init(ap)
 
@@ -1,7 +1,11 @@
 package main
 
-import "github.com/mumoshu/sopsed/cobraimpl"
+import (
+	"github.com/mumoshu/sopsed/cmd"
+	"github.com/mumoshu/sopsed/cobraimpl"
+)
 
 func main() {
-	cobraimpl.CreateCommand().Execute()
+	cobraimpl.CreateCommand()
+	cmd.Execute()
 }